@@ -1,8 +1,10 @@
 // Package fanotify library provides a simple API to monitor filesystem for notification and permission events.
 //
-// The listener is initialized with flags automatically based on the kernel version. The mark flag features that specify the
-// the events to monitor a file/directory are validated and checked for valid combinations and validated against the kernel
-// version.
+// The listener is initialized with flags automatically based on the features supported by the running kernel,
+// which are probed once and available through Features. The flags can be chosen explicitly
+// by creating the listener with NewListenerWithOptions. The mark flag features that specify the
+// the events to monitor a file/directory are validated and checked for valid combinations and validated against the features
+// of the kernel.
 //
 // fanotify system has features spanning different kernel versions:
 //   - For Linux kernel version 5.0 and earlier no additional information about the underlying filesystem object is available.
@@ -0,0 +1,208 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// allowCacheMask holds the permission events whose Allow decisions are cached
+const allowCacheMask = unix.FAN_OPEN_PERM | unix.FAN_ACCESS_PERM | unix.FAN_OPEN_EXEC_PERM
+
+// allowCache tracks the ignore marks installed for the files allowed by a listener
+// created with WithAllowCache.
+type allowCache struct {
+	// files maps the allowed files to their handles to remove the marks on flush
+	files map[fileID]unix.FileHandle
+	// mounts holds the root of a mount per device to open the handles of its files
+	mounts map[uint64]int
+}
+
+func newAllowCache() *allowCache {
+	return &allowCache{
+		files:  make(map[fileID]unix.FileHandle),
+		mounts: make(map[uint64]int),
+	}
+}
+
+// FlushAllowCache removes the Allow decisions cached for the listener created with
+// [WithAllowCache], so that the next accesses to the files generate permission
+// events again. It is a no-op for other listeners.
+func (l *Listener) FlushAllowCache() error {
+	if l == nil {
+		panic("nil listener")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.allowCache == nil || l.stopped {
+		return nil
+	}
+	return l.flushAllowCache()
+}
+
+// cacheAllow adds the event types of the permission event to the ignore mask of
+// its file before an Allow response is sent, so that the accesses following the
+// response do not generate events. The ignore mask does not survive modifications,
+// so the file is asked for again once written. Decisions on files that changed since
+// the event was read are not cached as they may not apply to the new content.
+// Only decisions on regular files are cached: the ignore mask of a directory also
+// applies to the events of its children when the directory is watched with
+// FAN_EVENT_ON_CHILD. cacheAllow reports whether the decision was cached.
+func (l *Listener) cacheAllow(e Event, d Decision) bool {
+	var stat unix.Stat_t
+
+	mask := uint64(e.EventTypes) & allowCacheMask
+	// the version is only set for listeners created with WithAllowCache
+	if d != Allow || mask == 0 || e.version == (fileVersion{}) {
+		return false
+	}
+	if unix.Fstat(e.Fd, &stat) != nil || stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return false
+	}
+	handle, mountID, err := unix.NameToHandleAt(e.Fd, "", unix.AT_EMPTY_PATH)
+	if err != nil {
+		return false
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	c := l.allowCache
+	if len(c.files) >= maxCacheEntries {
+		if err := l.flushAllowCache(); err != nil {
+			l.reportError(fmt.Errorf("flush allow cache: %w", err))
+		}
+	}
+	id := fileID{e.version.dev, e.version.ino}
+	if _, found := c.mounts[id.dev]; !found {
+		fd, err := openMount(mountID, id.dev)
+		if err != nil {
+			return false
+		}
+		c.mounts[id.dev] = fd
+	}
+	if err := unix.FanotifyMark(l.fd, unix.FAN_MARK_ADD|unix.FAN_MARK_IGNORED_MASK, mask, e.Fd, ""); err != nil {
+		if err == unix.ENOSPC {
+			err = ErrMarkLimit
+		}
+		l.reportError(fmt.Errorf("cache allow: %s: %w", eventPath(e), err))
+		return false
+	}
+	c.files[id] = handle
+	if version, err := statVersion(e.Fd); err != nil || version != e.version {
+		l.uncacheAllowLocked(e)
+		return false
+	}
+	return true
+}
+
+// uncacheAllow removes the ignore mark added by cacheAllow when the Allow response
+// could not be sent.
+func (l *Listener) uncacheAllow(e Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return
+	}
+	l.uncacheAllowLocked(e)
+}
+
+// uncacheAllowLocked removes the ignore mark of the file of the event. It must be
+// called with l.mu held.
+func (l *Listener) uncacheAllowLocked(e Event) {
+	unix.FanotifyMark(l.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_IGNORED_MASK, allowCacheMask, e.Fd, "")
+	delete(l.allowCache.files, fileID{e.version.dev, e.version.ino})
+}
+
+// openMount opens the root of the mount with the ID returned by name_to_handle_at
+// to open the handles of the files on the device. Unlike a file descriptor of one of
+// the files, it does not keep the file open once deleted. The mount point is looked
+// up in /proc/self/mountinfo.
+func openMount(mountID int, dev uint64) (int, error) {
+	var stat unix.Stat_t
+
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return -1, err
+	}
+	id := strconv.Itoa(mountID)
+	for _, line := range strings.Split(string(data), "\n") {
+		// mount ID, parent ID, major:minor, root, mount point, ...
+		fields := strings.Fields(line)
+		if len(fields) < 5 || fields[0] != id {
+			continue
+		}
+		// open_by_handle_at does not accept O_PATH file descriptors
+		fd, err := unix.Open(unescapeMountPath(fields[4]), unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC, 0)
+		if err != nil {
+			return -1, err
+		}
+		if err := unix.Fstat(fd, &stat); err != nil || stat.Dev != dev {
+			// the mount point is covered by another mount
+			unix.Close(fd)
+			return -1, fmt.Errorf("mount %d: %w", mountID, unix.ESTALE)
+		}
+		return fd, nil
+	}
+	return -1, fmt.Errorf("mount %d: %w", mountID, unix.ENOENT)
+}
+
+// unescapeMountPath decodes the octal escapes of the spaces, tabs, newlines and
+// backslashes of the paths in /proc/self/mountinfo
+func unescapeMountPath(path string) string {
+	var b strings.Builder
+
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// flushAllowCache removes the ignore marks of the cached decisions. The files are
+// opened with O_PATH, which fanotify_mark does not accept as a file descriptor, and
+// the marks are removed through their /proc/self/fd links. It must be called with
+// l.mu held.
+func (l *Listener) flushAllowCache() error {
+	c := l.allowCache
+	var firstErr error
+	for id, handle := range c.files {
+		fd, err := unix.OpenByHandleAt(c.mounts[id.dev], handle, unix.O_PATH|unix.O_CLOEXEC)
+		if err != nil {
+			// the file was deleted along with its marks
+			continue
+		}
+		err = unix.FanotifyMark(l.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_IGNORED_MASK, allowCacheMask, unix.AT_FDCWD, fmt.Sprintf("/proc/self/fd/%d", fd))
+		unix.Close(fd)
+		if err != nil && err != unix.ENOENT && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.resetAllowCache()
+	return firstErr
+}
+
+// resetAllowCache forgets the cached decisions once their marks are removed. It
+// must be called with l.mu held.
+func (l *Listener) resetAllowCache() {
+	if l.allowCache == nil {
+		return
+	}
+	for _, fd := range l.allowCache.mounts {
+		unix.Close(fd)
+	}
+	*l.allowCache = *newAllowCache()
+}
@@ -0,0 +1,209 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxCacheEntries bounds the number of files whose digests or scan results are cached
+const maxCacheEntries = 4096
+
+// ErrInvalidAllowlist indicates an allowlist that cannot be parsed
+var ErrInvalidAllowlist = errors.New("invalid allowlist")
+
+// Allowlist is a set of SHA-256 digests of the executables allowed to run.
+// The digests of the files checked are cached by device, inode, size and
+// modification and change times, so unchanged files are not hashed again.
+type Allowlist struct {
+	digests map[string]bool
+	mu      sync.Mutex
+	cache   map[fileVersion]string
+}
+
+// fileVersion identifies the content of a file without reading it
+type fileVersion struct {
+	dev   uint64
+	ino   uint64
+	size  int64
+	mtime unix.Timespec
+	ctime unix.Timespec
+}
+
+// NewAllowlist returns an allowlist of the hex encoded SHA-256 digests.
+func NewAllowlist(digests ...string) (*Allowlist, error) {
+	a := &Allowlist{
+		digests: make(map[string]bool),
+		cache:   make(map[fileVersion]string),
+	}
+	for _, digest := range digests {
+		if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%w: malformed sha256 %q", ErrInvalidAllowlist, digest)
+		}
+		a.digests[strings.ToLower(digest)] = true
+	}
+	return a, nil
+}
+
+// LoadAllowlist reads an allowlist in the format of sha256sum(1): each line holds
+// a hex encoded SHA-256 digest optionally followed by the file name, which is
+// ignored. Empty lines and lines starting with # are skipped.
+//
+//	# sha256sum /usr/bin/* > allowlist
+//	5f70bf18a086007016e948b04aed3b82103a36bea41755b6cddfaf10ace3c6ef  /usr/bin/ls
+func LoadAllowlist(r io.Reader) (*Allowlist, error) {
+	var digests []string
+
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if b, err := hex.DecodeString(fields[0]); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("%w: line %d: malformed sha256 %q", ErrInvalidAllowlist, n, fields[0])
+		}
+		digests = append(digests, fields[0])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewAllowlist(digests...)
+}
+
+// LoadAllowlistFile reads an allowlist from the file. See [LoadAllowlist].
+func LoadAllowlistFile(name string) (*Allowlist, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadAllowlist(f)
+}
+
+// Len returns the number of digests in the allowlist.
+func (a *Allowlist) Len() int {
+	return len(a.digests)
+}
+
+// Allowed returns true if the digest of the file of the event is in the allowlist.
+// The file is hashed through a duplicate of the file descriptor of the event, so
+// that the cached digest belongs to the file that was hashed even if the event is
+// closed concurrently and its file descriptor reused.
+func (a *Allowlist) Allowed(e Event) (bool, error) {
+	if e.Fd < 0 {
+		return false, fmt.Errorf("%w: event has no file descriptor", os.ErrInvalid)
+	}
+	dup, err := unix.FcntlInt(uintptr(e.Fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", eventPath(e), err)
+	}
+	defer unix.Close(dup)
+	digest, err := a.digest(dup)
+	if err != nil {
+		return false, fmt.Errorf("%s: %w", eventPath(e), err)
+	}
+	return a.digests[digest], nil
+}
+
+// statVersion returns the version of the file open as fd
+func statVersion(fd int) (fileVersion, error) {
+	var stat unix.Stat_t
+
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return fileVersion{}, fmt.Errorf("fstat: %w", err)
+	}
+	return fileVersion{
+		dev:   stat.Dev,
+		ino:   stat.Ino,
+		size:  stat.Size,
+		mtime: stat.Mtim,
+		ctime: stat.Ctim,
+	}, nil
+}
+
+// digest returns the digest of the file, from the cache if the file is unchanged.
+// fd must not be closed by another goroutine in the meantime.
+func (a *Allowlist) digest(fd int) (string, error) {
+	version, err := statVersion(fd)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	digest, found := a.cache[version]
+	a.mu.Unlock()
+	if found {
+		return digest, nil
+	}
+	digest, err = fileSHA256(fd)
+	if err != nil {
+		return "", err
+	}
+	a.mu.Lock()
+	if len(a.cache) >= maxCacheEntries {
+		a.cache = make(map[fileVersion]string)
+	}
+	a.cache[version] = digest
+	a.mu.Unlock()
+	return digest, nil
+}
+
+// EnforceAllowlist answers the [FileOpenToExecutePermission] events of the listener,
+// allowing the executables whose digest is in the allowlist and denying the others,
+// until the listener is stopped or ctx is done. Other permission events are allowed.
+// Executables that cannot be hashed are denied and the error is reported on the
+// Errors channel. The file descriptor and the pidfd of each event are closed once it
+// is answered. EnforceAllowlist must be the only consumer of the PermissionEvents
+// channel, and the process running the listener must not execute the files it checks
+// as it would wait for its own response.
+//
+// The executables of the mount point are checked with:
+//
+//	l, err := fanotify.NewListener("/", true, fanotify.PostContent)
+//	...
+//	err = l.WatchMount(fanotify.FileOpenToExecutePermission)
+//	...
+//	go l.Start()
+//	err = l.EnforceAllowlist(ctx, allowlist)
+func (l *Listener) EnforceAllowlist(ctx context.Context, a *Allowlist) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-l.PermissionEvents:
+			if !ok {
+				return nil
+			}
+			d := Allow
+			if e.EventTypes.Has(FileOpenToExecutePermission) {
+				allowed, err := a.Allowed(e)
+				if err != nil {
+					l.reportAsyncError(fmt.Errorf("allowlist: %w", err))
+				}
+				if !allowed {
+					d = Deny
+				}
+			}
+			if err := l.Respond(e, d); err != nil {
+				l.reportAsyncError(fmt.Errorf("respond: %s: %w", eventPath(e), err))
+			}
+			e.Process.Close()
+		}
+	}
+}
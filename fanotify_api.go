@@ -4,12 +4,13 @@
 package fanotify
 
 import (
-	"bytes"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
 	"golang.org/x/sys/unix"
 )
@@ -19,10 +20,23 @@ var (
 	ErrCapSysAdmin = errors.New("require CAP_SYS_ADMIN capability")
 	// ErrInvalidFlagCombination indicates the bit/combination of flags are invalid
 	ErrInvalidFlagCombination = errors.New("invalid flag bitmask")
-	// ErrUnsupportedOnKernelVersion indicates the feature/flag is unavailable for the current kernel version
+	// ErrUnsupportedOnKernelVersion indicates the feature/flag is unavailable for the current kernel version.
+	// The returned errors wrap it with the name of the flag and the minimum kernel version required.
 	ErrUnsupportedOnKernelVersion = errors.New("feature unsupported on current kernel version")
 	// ErrWatchPath indicates path needs to be specified for watching
 	ErrWatchPath = errors.New("missing watch path")
+	// ErrMarkLimit indicates the number of marks exceeded the limit of the listener.
+	// Use [WithUnlimitedMarks] to remove the limit.
+	ErrMarkLimit = errors.New("fanotify mark limit reached")
+	// ErrListenerStopped indicates the listener has been stopped and cannot be run again,
+	// respond to permission events or change its marks
+	ErrListenerStopped = errors.New("listener stopped")
+	// ErrRecursiveWatchRace indicates events may have been missed under a recursive
+	// watch, because a directory was changed before it could be marked.
+	ErrRecursiveWatchRace = errors.New("recursive watch race")
+	// ErrPermissionTimeout indicates a permission event was not answered before the
+	// deadline set with [WithPermissionTimeout] and received the default decision.
+	ErrPermissionTimeout = errors.New("permission event timed out")
 )
 
 // EventType represents an event / operation on a particular file/directory
@@ -42,6 +56,105 @@ const (
 	PostContent PermissionType = 2
 )
 
+// Decision is the response to a permission event.
+type Decision uint32
+
+const (
+	// Allow grants the access requested by the permission event.
+	Allow Decision = unix.FAN_ALLOW
+	// Deny denies the access requested by the permission event; the process
+	// requesting the access receives EPERM.
+	Deny Decision = unix.FAN_DENY
+)
+
+// DenyWithErrno returns a decision denying the access with errno instead of EPERM.
+// The errno must be one of EPERM, EIO, EBUSY, ETXTBSY, EAGAIN, ENOSPC or EDQUOT, the
+// errors expected when opening, reading or writing a regular file. Denying with an
+// errno requires a [PreContent] listener and Linux kernel 6.14 or later.
+func DenyWithErrno(errno unix.Errno) Decision {
+	return Deny | Decision(errno&0xff)<<fanDenyErrnoShift
+}
+
+// AuditRule identifies the rule that decided a permission event. The rule is logged
+// with the decision to the audit subsystem when the decision is sent with
+// [Decision.WithAudit].
+type AuditRule struct {
+	// RuleNumber is the number of the rule that decided the event
+	RuleNumber uint32
+	// SubjectTrust is the trust in the process requesting the access:
+	// 0 for not trusted, 1 for trusted and 2 for unknown
+	SubjectTrust uint32
+	// ObjectTrust is the trust in the file being accessed:
+	// 0 for not trusted, 1 for trusted and 2 for unknown
+	ObjectTrust uint32
+}
+
+// WithAudit returns the decision with the audit flag set, so the kernel logs the
+// decision to the audit subsystem. Requires the listener to be created with
+// [WithEnableAudit].
+func (d Decision) WithAudit() Decision {
+	return d | unix.FAN_AUDIT
+}
+
+// InfoType identifies the type of an information record of an event.
+type InfoType uint8
+
+const (
+	// InfoFID is a record holding the file identifier of the object of the event.
+	InfoFID InfoType = unix.FAN_EVENT_INFO_TYPE_FID
+	// InfoDFIDName is a record holding the file identifier of the parent directory
+	// and the name of the object of the event.
+	InfoDFIDName InfoType = unix.FAN_EVENT_INFO_TYPE_DFID_NAME
+	// InfoDFID is a record holding the file identifier of the parent directory of
+	// the object of the event.
+	InfoDFID InfoType = unix.FAN_EVENT_INFO_TYPE_DFID
+	// InfoPIDFD is a record holding a pidfd of the process that caused the event.
+	InfoPIDFD InfoType = unix.FAN_EVENT_INFO_TYPE_PIDFD
+	// InfoError is a record holding the error of a filesystem error event.
+	InfoError InfoType = unix.FAN_EVENT_INFO_TYPE_ERROR
+	// InfoOldDFIDName is a record holding the file identifier of the parent directory
+	// and the name of the object before it was renamed.
+	InfoOldDFIDName InfoType = unix.FAN_EVENT_INFO_TYPE_OLD_DFID_NAME
+	// InfoNewDFIDName is a record holding the file identifier of the parent directory
+	// and the name of the object after it was renamed.
+	InfoNewDFIDName InfoType = unix.FAN_EVENT_INFO_TYPE_NEW_DFID_NAME
+	// InfoRange is a record holding the range of the file accessed by a [FilePreAccess] event.
+	InfoRange InfoType = fanEventInfoTypeRange
+)
+
+// InfoRecord represents an information record reported by the kernel along with
+// an event. Only the fields relevant to the type of the record are set.
+type InfoRecord struct {
+	// Type is the type of the record
+	Type InfoType
+	// Fsid identifies the filesystem of the object for the file identifier records.
+	Fsid unix.Fsid
+	// Handle is the file handle of the object for the file identifier records.
+	Handle *unix.FileHandle
+	// Name is the name of the object for [InfoDFIDName], [InfoOldDFIDName]
+	// and [InfoNewDFIDName] records.
+	Name string
+	// Pidfd is the pidfd of the process that caused the event for [InfoPIDFD] records
+	// and -1 otherwise. A negative value in a [InfoPIDFD] record indicates the pidfd
+	// could not be created.
+	Pidfd int
+	// Error is the errno of the filesystem error for [InfoError] records.
+	Error int32
+	// ErrorCount is the number of filesystem errors since the last error event
+	// for [InfoError] records.
+	ErrorCount uint32
+	// Offset is the offset of the accessed range for [InfoRange] records.
+	Offset int64
+	// Count is the length of the accessed range for [InfoRange] records.
+	Count int64
+}
+
+// FileRange is a range of bytes of a file.
+type FileRange struct {
+	Offset int64
+	Count  int64
+}
+
 // Event represents a notification or a permission event from the kernel for the file,
 // directory marked for watching.
 // Notification events are merely informative and require
@@ -51,7 +164,10 @@ const (
 // for a file access shall be granted. For these events, the recipient must write a
 // response which decides whether access is granted or not.
 type Event struct {
-	// Fd is the open file descriptor for the file/directory being watched
+	// Fd is the open file descriptor for the file/directory being watched.
+	// The value is unix.FAN_NOFD for [QueueOverflow] events. Close it with
+	// [Event.Close] or take it over with [Event.File]; descriptors never closed
+	// are counted by [Listener.LeakedFds].
 	Fd int
 	// Path holds the name of the parent directory
 	Path string
@@ -59,10 +175,56 @@ type Event struct {
 	// on kernels 5.1 or greater (that support the receipt of events which contain additional information
 	// about the underlying filesystem object correlated to an event).
 	FileName string
+	// OldPath holds the name of the parent directory the file was renamed from.
+	// The value is only available for [FileRenamed] events.
+	OldPath string
+	// OldFileName holds the name of the file before it was renamed.
+	// The value is only available for [FileRenamed] events.
+	OldFileName string
+	// NewPath holds the name of the parent directory the file was renamed to.
+	// The value is only available for [FileRenamed] events; Path holds the same value.
+	NewPath string
+	// NewFileName holds the name of the file after it was renamed.
+	// The value is only available for [FileRenamed] events; FileName holds the same value.
+	NewFileName string
 	// EventTypes holds bit mask representing the operations
 	EventTypes EventType
-	// Pid Process ID of the process that caused the event
+	// Pid Process ID of the process that caused the event. For listeners created with
+	// [WithReportTid] the kernel reports the thread ID instead and Pid holds the same
+	// value as Tid.
 	Pid int
+	// Tid Thread ID of the thread that caused the event. The value is only available
+	// for listeners created with [WithReportTid].
+	Tid int
+	// Process refers to the process that caused the event through a pidfd. The value is
+	// only available for listeners created with [WithReportPidfd] and must be closed.
+	Process *Process
+	// Errno holds the error reported by the filesystem.
+	// The value is only available for [FilesystemError] events.
+	Errno unix.Errno
+	// ErrorCount holds the number of errors reported by the filesystem since the
+	// previous [FilesystemError] event. The value is only available for [FilesystemError] events.
+	ErrorCount uint32
+	// FileHandle holds the file handle of the file affected by the filesystem error.
+	// The handle is not opened as the file may be corrupted. The type of the handle is
+	// FILEID_INVALID (0xff) when the error is not associated with a file.
+	// The value is only available for [FilesystemError] events.
+	FileHandle *unix.FileHandle
+	// Range holds the range of the file about to be accessed for [FilePreAccess]
+	// events. The value is nil when the whole file is about to be accessed.
+	Range *FileRange
+	// Info holds the information records reported with the event, in the order
+	// reported by the kernel.
+	Info []InfoRecord
+	// seq identifies permission events while their response is pending
+	seq uint64
+	// received is the time the permission event was read
+	received time.Time
+	// version identifies the content of the file when the permission event was read
+	// by listeners created with WithAllowCache
+	version fileVersion
+	// owner closes Fd once for all the copies of the event
+	owner *eventFd
 }
 
 // Listener represents a generic notification group that holds a list of files,
@@ -73,21 +235,58 @@ type Listener struct {
 	fd int
 	// flags passed to fanotify_init
 	flags uint
+	// event_f_flags passed to fanotify_init
+	eventFlags uint
 	// mount fd is the file descriptor of the mountpoint
-	mountpoint         *os.File
-	kernelMajorVersion int
-	kernelMinorVersion int
-	entireMount        bool
-	notificationOnly   bool
-	watches            map[string]bool
-	stopper            struct {
-		r *os.File
-		w *os.File
+	mountpoint *os.File
+	// features supported by the kernel
+	features         FeatureSet
+	entireMount      bool
+	notificationOnly bool
+	// unprivileged is true for listeners created with WithUnprivileged
+	unprivileged bool
+	// handles maps the file handles of the marked paths to the paths of unprivileged
+	// listeners, which cannot open file handles
+	handles map[string]string
+	watches map[markKey]bool
+	// recursive maps the directories marked by AddRecursiveWatch to their watch
+	recursive map[string]*recursiveDir
+	stopper   struct {
+		r int
+		w int
 	}
+	// mu guards stopped, the registration of runners with wg and the watch lists
+	mu      sync.Mutex
+	stopped bool
+	// permission events pending a response before the deadline set with
+	// WithPermissionTimeout, by file descriptor
+	permissionTimeout  time.Duration
+	timeoutDecision    Decision
+	pending            map[int]*pendingPermission
+	permissionTimeouts uint64
+	seq                uint64
+	// decisionReporter is called with the responses sent to permission events
+	decisionReporter func(PermissionDecision)
+	// allowCache tracks the Allow decisions cached for listeners created with
+	// WithAllowCache; nil otherwise
+	allowCache *allowCache
+	// autoClose is true for listeners created with WithAutoClose
+	autoClose bool
+	// fds maps the open file descriptors of the events to the id of their owner
+	fds       map[int]uint64
+	fdSeq     uint64
+	leakedFds uint64
+	// done is closed by Stop to unblock event delivery
+	done chan struct{}
+	wg   sync.WaitGroup
 	// Events holds either notification events for the watched file/directory.
 	Events chan Event
 	// PermissionEvents holds permission request events for the watched file/directory.
 	PermissionEvents chan Event
+	// Errors holds non-fatal errors encountered while processing individual events,
+	// for example when the path of an event cannot be resolved. The send is non-blocking;
+	// errors are dropped when the channel is full.
+	Errors chan error
 }
 
 // NewListener returns a fanotify listener from which filesystem
@@ -121,78 +320,105 @@ type Listener struct {
 //   files when they already contain their final content.
 //
 // The function returns a new instance of the listener. The fanotify flags
-// are set based on the running kernel version. [ErrCapSysAdmin] is returned
+// are set based on the features of the running kernel (see [Features]). [ErrCapSysAdmin] is returned
 // if the process does not have CAP_SYS_ADM capability.
 //
 //  - For Linux kernel version 5.0 and earlier no additional information about the underlying filesystem object is available.
 //  - For Linux kernel versions 5.1 till 5.8 (inclusive) additional information about the underlying filesystem object is correlated to an event.
 //  - For Linux kernel version 5.9 or later the modified file name is made available in the event.
 func NewListener(mountPoint string, entireMount bool, permType PermissionType) (*Listener, error) {
-	capSysAdmin, err := checkCapSysAdmin()
-	if err != nil {
-		return nil, err
-	}
-	if !capSysAdmin {
-		return nil, ErrCapSysAdmin
+	return NewListenerWithOptions(mountPoint, WithEntireMount(entireMount), WithPermissionType(permType))
+}
+
+// NewListenerWithOptions returns a fanotify listener configured by the given options.
+// Without options it behaves as NewListener(mountPoint, false, PermissionNone).
+// The fanotify_init flags that are not explicitly chosen by the options are set
+// based on the features of the running kernel as described in [NewListener].
+// [ErrInvalidFlagCombination] is returned if the resulting flags cannot be combined
+// and [ErrCapSysAdmin] is returned if the process does not have CAP_SYS_ADM capability,
+// unless the listener is created with [WithUnprivileged].
+func NewListenerWithOptions(mountPoint string, opts ...Option) (*Listener, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
 	}
-	isNotificationListener := true
-	if permType == PreContent || permType == PostContent {
-		isNotificationListener = false
+	if !o.unprivileged {
+		capSysAdmin, err := checkCapSysAdmin()
+		if err != nil {
+			return nil, err
+		}
+		if !capSysAdmin {
+			return nil, ErrCapSysAdmin
+		}
 	}
-	return newListener(mountPoint, entireMount, isNotificationListener, permType)
+	return newListener(mountPoint, o)
 }
 
 // Start starts the listener and polls the fanotify event notification group for marked events.
-// The events are pushed into the Listener's Events channel.
+// The events are pushed into the Listener's Events channel. Start blocks until [Stop] is called.
+// An error that terminates the listener is pushed into the Listener's Errors channel. Use [Run]
+// to stop the listener through a context and receive the terminating error directly.
 func (l *Listener) Start() {
-	var fds [2]unix.PollFd
 	if l == nil {
 		panic("nil listener")
 	}
-	// Fanotify Fd
-	fds[0].Fd = int32(l.fd)
-	fds[0].Events = unix.POLLIN
-	// Stopper/Cancellation Fd
-	fds[1].Fd = int32(l.stopper.r.Fd())
-	fds[1].Events = unix.POLLIN
-	for {
-		n, err := unix.Poll(fds[:], -1)
-		if n == 0 {
-			continue
-		}
-		if err != nil {
-			if err == unix.EINTR {
-				continue
-			} else {
-				// TODO handle error
-				return
-			}
-		}
-		if fds[1].Revents != 0 {
-			if fds[1].Revents&unix.POLLIN == unix.POLLIN {
-				// found data on the stopper
-				return
-			}
-		}
-		if fds[0].Revents != 0 {
-			if fds[0].Revents&unix.POLLIN == unix.POLLIN {
-				l.readEvents() // blocks when the channel bufferred is full
-			}
-		}
+	if !l.acquire() {
+		return
+	}
+	defer l.wg.Done()
+	if err := l.run(context.Background()); err != nil {
+		l.reportError(err)
+	}
+}
+
+// Run starts the listener and polls the fanotify event notification group for marked events
+// until the context is cancelled or [Stop] is called. The events are pushed into the Listener's
+// Events and PermissionEvents channels.
+//
+// Run returns ctx.Err() when the context is cancelled and nil when the listener is stopped.
+// Any other returned error is the terminal error from polling or reading the notification group.
+// Failures to process an individual event do not stop the listener; they are pushed into the
+// Listener's Errors channel and the event is dropped. Events read but not delivered when
+// the context is cancelled are dropped as well; the permission events among them are allowed.
+func (l *Listener) Run(ctx context.Context) error {
+	if l == nil {
+		panic("nil listener")
 	}
+	if !l.acquire() {
+		return ErrListenerStopped
+	}
+	defer l.wg.Done()
+	return l.run(ctx)
 }
 
-// Stop stops the listener and closes the notification group and the events channel
+// Stop stops the listener and closes the notification group, the events, permission events
+// and errors channels. Stop waits for a running [Start] or [Run] to return. The marks of a
+// stopped listener cannot be changed; the methods adding or removing marks return
+// [ErrListenerStopped].
 func (l *Listener) Stop() {
 	if l == nil {
 		return
 	}
+	l.mu.Lock()
+	if l.stopped {
+		l.mu.Unlock()
+		return
+	}
+	l.stopped = true
+	close(l.done)
+	l.stopPermissionTimers()
+	l.resetAllowCache()
+	l.mu.Unlock()
 	// stop the listener
-	unix.Write(int(l.stopper.w.Fd()), []byte("stop"))
+	l.wakeup()
+	l.wg.Wait()
+	unix.Close(l.fd)
 	l.mountpoint.Close()
-	l.stopper.r.Close()
-	l.stopper.w.Close()
+	unix.Close(l.stopper.r)
+	unix.Close(l.stopper.w)
 	close(l.Events)
+	close(l.PermissionEvents)
+	close(l.Errors)
 }
 
 // WatchMount adds or modifies the notification marks for the entire
@@ -213,6 +439,40 @@ func (l *Listener) UnwatchMount(eventTypes EventType) error {
 	return l.fanotifyMark(l.mountpoint.Name(), unix.FAN_MARK_REMOVE|unix.FAN_MARK_MOUNT, uint64(eventTypes))
 }
 
+// WatchFilesystem adds or modifies the notification marks for the entire filesystem
+// containing the mount point. Unlike [WatchMount], events are raised for the filesystem
+// object regardless of the mount it is accessed through, for example bind mounts.
+// This method returns an [ErrWatchPath] if the listener was not initialized to monitor
+// the entire mount point. Requires Linux kernel 4.20 or later.
+//
+// Filesystem marks can be watched for [FileCreated], [FileAttribChanged], [FileMovedTo],
+// [FileMovedFrom], [WatchedFileDeleted], [FileDeleted] and their OrDirectory variants
+// when the listener reports file identifiers, for example when created with
+// [WithEntireMount](true) and [WithReportFlags](unix.FAN_REPORT_DFID_NAME).
+// Otherwise WatchFilesystem returns [ErrInvalidFlagCombination] for these event types.
+func (l *Listener) WatchFilesystem(eventTypes EventType) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if !l.entireMount {
+		return ErrWatchPath
+	}
+	return l.fanotifyMark(l.mountpoint.Name(), unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, uint64(eventTypes))
+}
+
+// UnwatchFilesystem removes the notification marks for the entire filesystem.
+// This method returns an [ErrWatchPath] if the listener was not initialized to monitor
+// the entire mount point.
+func (l *Listener) UnwatchFilesystem(eventTypes EventType) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if !l.entireMount {
+		return ErrWatchPath
+	}
+	return l.fanotifyMark(l.mountpoint.Name(), unix.FAN_MARK_REMOVE|unix.FAN_MARK_FILESYSTEM, uint64(eventTypes))
+}
+
 // AddWatch adds or modifies the fanotify mark for the specified path.
 // The events are only raised for the specified directory and does raise events
 // for subdirectories. Calling AddWatch to mark the entire mountpoint results in
@@ -231,24 +491,144 @@ func (l *Listener) AddWatch(path string, eventTypes EventType) error {
 	return l.fanotifyMark(path, unix.FAN_MARK_ADD, uint64(eventTypes|unix.FAN_EVENT_ON_CHILD))
 }
 
+// AddIgnore adds the event types to the ignore mask of the specified path, so
+// the events are not raised for the path even when it is watched through
+// [WatchMount], [WatchFilesystem] or [AddWatch] of its parent directory.
+// Unlike filtering the received events, ignored events are dropped by the kernel
+// before a file descriptor is opened for them. The ignore mask survives
+// modifications of the file.
+//
+// On Linux kernel 6.0 or later ignoring a directory also ignores the events of
+// its direct children, and passing the OrDirectory variants of the event types
+// ignores the events on the directory itself. On earlier kernels only the events
+// on the path itself are ignored.
+func (l *Listener) AddIgnore(path string, eventTypes EventType) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	flags, mask := l.ignoreMark(path, eventTypes)
+	return l.fanotifyMark(path, unix.FAN_MARK_ADD|unix.FAN_MARK_IGNORED_SURV_MODIFY|flags, mask)
+}
+
+// RemoveIgnore removes the event types from the ignore mask of the specified path.
+func (l *Listener) RemoveIgnore(path string, eventTypes EventType) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	flags, mask := l.ignoreMark(path, eventTypes)
+	return l.fanotifyMark(path, unix.FAN_MARK_REMOVE|flags, mask)
+}
+
 // Allow sends an "allowed" response to the permission request event.
+// Errors are ignored; use [Respond] to receive them.
 func (l *Listener) Allow(e Event) {
-	var response unix.FanotifyResponse
-	response.Fd = int32(e.Fd)
-	response.Response = unix.FAN_ALLOW
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, &response)
-	unix.Write(l.fd, buf.Bytes())
+	if l.claimPermission(e) != nil {
+		return
+	}
+	cached := l.cacheAllow(e, Allow)
+	if l.sendResponse(e.Fd, Allow, nil) != nil {
+		if cached {
+			l.uncacheAllow(e)
+		}
+		return
+	}
+	l.reportDecision(e, Allow)
 }
 
 // Deny sends an "denied" response to the permission request event.
+// Errors are ignored; use [Respond] to receive them.
 func (l *Listener) Deny(e Event) {
-	var response unix.FanotifyResponse
-	response.Fd = int32(e.Fd)
-	response.Response = unix.FAN_DENY
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.LittleEndian, &response)
-	unix.Write(l.fd, buf.Bytes())
+	if l.claimPermission(e) == nil && l.sendResponse(e.Fd, Deny, nil) == nil {
+		l.reportDecision(e, Deny)
+	}
+}
+
+// Respond sends the decision for the permission request event and closes the file
+// descriptor of the event, whether or not the response could be written. An error
+// is returned if the response was not accepted by the kernel, in which case the
+// access stays blocked until the listener is stopped.
+//
+// Decisions with [Decision.WithAudit] require the listener to be created with
+// [WithEnableAudit] and decisions created with [DenyWithErrno] require a [PreContent]
+// listener; [ErrInvalidFlagCombination] is returned otherwise. Invalid decisions are
+// rejected before responding and leave the file descriptor open, so a valid decision
+// can still be sent for the event.
+//
+// For listeners created with [WithPermissionTimeout], an error wrapping
+// [ErrPermissionTimeout] is returned if the event already received the default
+// decision; its file descriptor is closed all the same. [ErrListenerStopped]
+// is returned once the listener is stopped, as closing the notification group allows
+// the pending accesses.
+func (l *Listener) Respond(e Event, d Decision) error {
+	return l.respond(e, d, nil)
+}
+
+// RespondWithAuditRule sends the decision for the permission request event along with
+// the audit rule that decided it, and closes the file descriptor of the event as
+// [Respond] does. Requires Linux kernel 6.3 or later.
+func (l *Listener) RespondWithAuditRule(e Event, d Decision, rule AuditRule) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if !l.features.ResponseInfo {
+		return fmt.Errorf("%w: audit rules require Linux kernel 6.3 or later", ErrUnsupportedOnKernelVersion)
+	}
+	return l.respond(e, d, auditRuleInfo(rule))
+}
+
+func (l *Listener) respond(e Event, d Decision, info []byte) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if e.Fd < 0 {
+		return fmt.Errorf("%w: event has no file descriptor", os.ErrInvalid)
+	}
+	if err := checkDecision(l.flags, l.features, d); err != nil {
+		return err
+	}
+	defer e.Close()
+	if err := l.claimPermission(e); err != nil {
+		return err
+	}
+	cached := l.cacheAllow(e, d)
+	if err := l.sendResponse(e.Fd, d, info); err != nil {
+		if cached {
+			l.uncacheAllow(e)
+		}
+		return err
+	}
+	l.reportDecision(e, d)
+	return nil
+}
+
+// WriteContent writes p at offset into the file of the event through its file
+// descriptor, typically to fill the range of a [FilePreAccess] event before allowing
+// it. Writes through the file descriptor of an event do not generate events, so the
+// content can be written while the access waits for the response. Requires a
+// listener created with [WithReadWrite]; [ErrInvalidFlagCombination] is returned
+// otherwise.
+func (l *Listener) WriteContent(e Event, p []byte, offset int64) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if e.Fd < 0 {
+		return fmt.Errorf("%w: event has no file descriptor", os.ErrInvalid)
+	}
+	if l.eventFlags&unix.O_ACCMODE != unix.O_RDWR {
+		return fmt.Errorf("%w: writing content requires a listener created with WithReadWrite", ErrInvalidFlagCombination)
+	}
+	for len(p) > 0 {
+		n, err := unix.Pwrite(e.Fd, p, offset)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "pwrite", Path: eventPath(e), Err: err}
+		}
+		p = p[n:]
+		offset += int64(n)
+	}
+	return nil
 }
 
 // DeleteWatch removes/unmarks the fanotify mark for the specified path.
@@ -261,15 +641,30 @@ func (l *Listener) DeleteWatch(parentDir string, eventTypes EventType) error {
 	return l.fanotifyMark(parentDir, unix.FAN_MARK_REMOVE, uint64(eventTypes|unix.FAN_EVENT_ON_CHILD))
 }
 
-// ClearWatch stops watching for all event types
+// ClearWatch stops watching for all event types. The marks on files, directories,
+// the mount point and the filesystem are removed, including the ignore masks added
+// with [AddIgnore].
 func (l *Listener) ClearWatch() error {
 	if l == nil {
 		panic("nil listener")
 	}
-	if err := unix.FanotifyMark(l.fd, unix.FAN_MARK_FLUSH, 0, -1, ""); err != nil {
-		return err
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return ErrListenerStopped
+	}
+	markTypes := map[uint]bool{0: true}
+	for key := range l.watches {
+		markTypes[key.markType&markTypeMask] = true
+	}
+	for markType := range markTypes {
+		if err := unix.FanotifyMark(l.fd, unix.FAN_MARK_FLUSH|markType, 0, -1, ""); err != nil {
+			return err
+		}
 	}
-	l.watches = make(map[string]bool)
+	l.watches = make(map[markKey]bool)
+	l.recursive = make(map[string]*recursiveDir)
+	l.resetAllowCache()
 	return nil
 }
 
@@ -299,9 +694,13 @@ func (e EventType) String() string {
 		unix.FAN_MOVED_FROM:     "MovedFrom",
 		unix.FAN_MOVED_TO:       "MovedTo",
 		unix.FAN_MOVE_SELF:      "SelfMove",
+		unix.FAN_RENAME:         "Rename",
 		unix.FAN_OPEN_PERM:      "PermissionToOpen",
 		unix.FAN_OPEN_EXEC_PERM: "PermissionToExecute",
 		unix.FAN_ACCESS_PERM:    "PermissionToAccess",
+		fanPreAccess:            "PreAccess",
+		unix.FAN_FS_ERROR:       "FilesystemError",
+		unix.FAN_Q_OVERFLOW:     "QueueOverflow",
 	}
 	var eventTypeList []string
 	for k, v := range eventTypes {
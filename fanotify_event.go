@@ -2,12 +2,13 @@ package fanotify
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"os"
-	"regexp"
-	"strconv"
+	"path/filepath"
 	"unsafe"
 
 	"github.com/opcoder0/capabilities"
@@ -18,6 +19,38 @@ const (
 	sizeOfFanotifyEventMetadata = uint32(unsafe.Sizeof(unix.FanotifyEventMetadata{}))
 )
 
+// These fanotify constants are not defined in golang.org/x/sys/unix
+const (
+	fanMarkIgnore = 0x00000400
+	// permission response flag indicating information records follow the response
+	fanInfo = 0x20
+	// information record type of the audit rule of a permission response
+	fanResponseInfoAuditRule = 1
+	// shift of the errno of a denial in the permission response
+	fanDenyErrnoShift = 24
+	// pre-content event before the content of a file is accessed
+	fanPreAccess = 0x00100000
+	// information record type of the range of a pre-content event
+	fanEventInfoTypeRange = 6
+)
+
+const (
+	// fanotify_mark flags selecting the type of the mark
+	markTypeMask = unix.FAN_MARK_MOUNT | unix.FAN_MARK_FILESYSTEM
+	// fanotify_mark flags updating the ignore mask instead of the mask of the mark
+	ignoreMask = unix.FAN_MARK_IGNORED_MASK | fanMarkIgnore
+)
+
+// markKey identifies a mark of the listener by the marked path and the mark type.
+// Ignore masks are tracked separately from the marks of the same path.
+type markKey struct {
+	path     string
+	markType uint
+}
+
+// errMalformedEvent indicates an event that could not be decoded
+var errMalformedEvent = errors.New("malformed event")
+
 // These fanotify structs are not defined in golang.org/x/sys/unix
 type fanotifyEventInfoHeader struct {
 	InfoType uint8
@@ -25,38 +58,13 @@ type fanotifyEventInfoHeader struct {
 	Len      uint16
 }
 
-// FanotifyEventInfoFID represents a unique file identifier info record.
-// This structure is used for records of types FAN_EVENT_INFO_TYPE_FID,
-// FAN_EVENT_INFO_TYPE_DFID and FAN_EVENT_INFO_TYPE_DFID_NAME.
-// For FAN_EVENT_INFO_TYPE_DFID_NAME there is additionally a null terminated
-// name immediately after the file handle.
-type fanotifyEventInfoFID struct {
-	Header     fanotifyEventInfoHeader
-	fsid       unix.Fsid
-	fileHandle byte
-}
-
-// returns major, minor, patch version of the kernel
-// upon error the string values are empty and the error
-// indicates the reason for failure
-func kernelVersion() (maj, min, patch int, err error) {
-	var sysinfo unix.Utsname
-	err = unix.Uname(&sysinfo)
-	if err != nil {
-		return
-	}
-	re := regexp.MustCompile(`([0-9]+)`)
-	version := re.FindAllString(string(sysinfo.Release[:]), -1)
-	if maj, err = strconv.Atoi(version[0]); err != nil {
-		return
-	}
-	if min, err = strconv.Atoi(version[1]); err != nil {
-		return
-	}
-	if patch, err = strconv.Atoi(version[2]); err != nil {
-		return
-	}
-	return maj, min, patch, nil
+type fanotifyResponseInfoAuditRule struct {
+	Type       uint8
+	pad        uint8
+	Len        uint16
+	RuleNumber uint32
+	SubjTrust  uint32
+	ObjTrust   uint32
 }
 
 // return true if process has CAP_SYS_ADMIN privilege
@@ -79,27 +87,63 @@ func flagsValid(flags uint) error {
 	if isSet(flags, unix.FAN_REPORT_FID|unix.FAN_CLASS_PRE_CONTENT) {
 		return errors.New("FAN_REPORT_FID cannot be set with FAN_CLASS_PRE_CONTENT")
 	}
+	if isSet(flags, unix.FAN_REPORT_DIR_FID|unix.FAN_CLASS_CONTENT) {
+		return errors.New("FAN_REPORT_DIR_FID cannot be set with FAN_CLASS_CONTENT")
+	}
+	if isSet(flags, unix.FAN_REPORT_DIR_FID|unix.FAN_CLASS_PRE_CONTENT) {
+		return errors.New("FAN_REPORT_DIR_FID cannot be set with FAN_CLASS_PRE_CONTENT")
+	}
+	if isSet(flags, unix.FAN_REPORT_PIDFD|unix.FAN_REPORT_TID) {
+		return errors.New("FAN_REPORT_PIDFD cannot be set with FAN_REPORT_TID")
+	}
 	if isSet(flags, unix.FAN_REPORT_NAME) {
 		if !isSet(flags, unix.FAN_REPORT_DIR_FID) {
 			return errors.New("FAN_REPORT_NAME must be set with FAN_REPORT_DIR_FID")
 		}
 	}
+	if isSet(flags, unix.FAN_REPORT_TARGET_FID) {
+		if !isSet(flags, unix.FAN_REPORT_FID|unix.FAN_REPORT_DFID_NAME) {
+			return errors.New("FAN_REPORT_TARGET_FID must be set with FAN_REPORT_FID and FAN_REPORT_DFID_NAME")
+		}
+	}
 	return nil
 }
 
-func isFanotifyMarkMaskValid(flags uint, mask uint64) error {
+func isFanotifyMarkMaskValid(initFlags, flags uint, mask uint64) error {
 	isSet := func(n, k uint64) bool {
 		return n&k == k
 	}
+	inodeEvents := isSet(mask, unix.FAN_CREATE) ||
+		isSet(mask, unix.FAN_ATTRIB) ||
+		isSet(mask, unix.FAN_MOVE) ||
+		isSet(mask, unix.FAN_MOVED_FROM) ||
+		isSet(mask, unix.FAN_MOVED_TO) ||
+		isSet(mask, unix.FAN_MOVE_SELF) ||
+		isSet(mask, unix.FAN_DELETE_SELF) ||
+		isSet(mask, unix.FAN_DELETE) ||
+		isSet(mask, unix.FAN_RENAME)
 	if isSet(uint64(flags), unix.FAN_MARK_MOUNT) {
-		if isSet(mask, unix.FAN_CREATE) ||
-			isSet(mask, unix.FAN_ATTRIB) ||
-			isSet(mask, unix.FAN_MOVE) ||
-			isSet(mask, unix.FAN_DELETE_SELF) ||
-			isSet(mask, unix.FAN_DELETE) {
+		if inodeEvents {
 			return errors.New("mountpoint cannot be watched for create, attrib, move or delete self event types")
 		}
 	}
+	if inodeEvents && flags&unix.FAN_MARK_REMOVE == 0 && initFlags&(unix.FAN_REPORT_FID|unix.FAN_REPORT_DIR_FID) == 0 {
+		return errors.New("create, attrib, move or delete event types require the listener to report file identifiers (FAN_REPORT_FID or FAN_REPORT_DIR_FID)")
+	}
+	if isSet(mask, unix.FAN_FS_ERROR) && flags&unix.FAN_MARK_REMOVE == 0 {
+		if !isSet(uint64(flags), unix.FAN_MARK_FILESYSTEM) {
+			return errors.New("filesystem error event type can only be watched on a filesystem mark")
+		}
+		if initFlags&(unix.FAN_REPORT_FID|unix.FAN_REPORT_DIR_FID) == 0 {
+			return errors.New("filesystem error event type requires the listener to report file identifiers (FAN_REPORT_FID or FAN_REPORT_DIR_FID)")
+		}
+	}
+	if isSet(mask, unix.FAN_RENAME) && flags&unix.FAN_MARK_REMOVE == 0 && initFlags&unix.FAN_REPORT_NAME == 0 {
+		return errors.New("rename event type requires the listener to report directory file identifiers and names (FAN_REPORT_DFID_NAME)")
+	}
+	if isSet(mask, fanPreAccess) && flags&unix.FAN_MARK_REMOVE == 0 && !isSet(uint64(initFlags), unix.FAN_CLASS_PRE_CONTENT) {
+		return errors.New("pre-access event type requires a PreContent listener")
+	}
 	return nil
 }
 
@@ -116,177 +160,170 @@ func checkMask(mask uint64, validEventTypes []EventType) error {
 	return nil
 }
 
-// Check if specified fanotify_init flags are supported for the given
-// kernel version. If none of the defined flags are specified
-// then the basic option works on any kernel version.
-func fanotifyInitFlagsKernelSupport(flags uint, maj, min int) bool {
-	type kernelVersion struct {
-		maj int
-		min int
-	}
-	// fanotify init flags
-	var flagPerKernelVersion = map[uint]kernelVersion{
-		unix.FAN_ENABLE_AUDIT:     {4, 15},
-		unix.FAN_REPORT_FID:       {5, 1},
-		unix.FAN_REPORT_DIR_FID:   {5, 9},
-		unix.FAN_REPORT_NAME:      {5, 9},
-		unix.FAN_REPORT_DFID_NAME: {5, 9},
-	}
-
-	check := func(n, k uint, w, x int) (bool, error) {
-		if n&k == k {
-			if maj > w {
-				return true, nil
-			} else if maj == w && min >= x {
-				return true, nil
-			}
-			return false, nil
-		}
-		return false, errors.New("flag not set")
-	}
-	for flag, ver := range flagPerKernelVersion {
-		if v, err := check(flags, flag, ver.maj, ver.min); err != nil {
-			continue // flag not set; check other flags
-		} else {
-			return v
-		}
-	}
-	// if none of these flags were specified then the basic option
-	// works on any kernel version
-	return true
+func fanotifyEventOK(meta *unix.FanotifyEventMetadata, n int) bool {
+	return (n >= int(sizeOfFanotifyEventMetadata) &&
+		meta.Event_len >= sizeOfFanotifyEventMetadata &&
+		int(meta.Event_len) <= n)
 }
 
-// Check if specified fanotify_mark flags are supported for the given
-// kernel version. If none of the defined flags are specified
-// then the basic option works on any kernel version.
-func fanotifyMarkFlagsKernelSupport(flags uint64, maj, min int) bool {
-	type kernelVersion struct {
-		maj int
-		min int
-	}
-	// fanotify mark flags
-	var fanotifyMarkFlags = map[uint64]kernelVersion{
-		unix.FAN_OPEN_EXEC:   {5, 0},
-		unix.FAN_ATTRIB:      {5, 1},
-		unix.FAN_CREATE:      {5, 1},
-		unix.FAN_DELETE:      {5, 1},
-		unix.FAN_DELETE_SELF: {5, 1},
-		unix.FAN_MOVED_FROM:  {5, 1},
-		unix.FAN_MOVED_TO:    {5, 1},
-	}
-
-	check := func(n, k uint64, w, x int) (bool, error) {
-		if n&k == k {
-			if maj > w {
-				return true, nil
-			} else if maj == w && min >= x {
-				return true, nil
-			}
-			return false, nil
-		}
-		return false, errors.New("flag not set")
-	}
-	for flag, ver := range fanotifyMarkFlags {
-		if v, err := check(flags, flag, ver.maj, ver.min); err != nil {
-			continue // flag not set; check other flags
-		} else {
-			return v
-		}
+// defaultReportFlags returns the FAN_REPORT_* flags for a notification listener
+// based on the features supported by the kernel.
+func defaultReportFlags(features FeatureSet, entireMount bool) uint {
+	// FAN_MARK_MOUNT cannot be specified with FAN_REPORT_FID, FAN_REPORT_DIR_FID, FAN_REPORT_NAME
+	if entireMount {
+		return 0
+	}
+	switch {
+	case features.HasInitFlags(unix.FAN_REPORT_DIR_FID | unix.FAN_REPORT_NAME):
+		return unix.FAN_REPORT_DIR_FID | unix.FAN_REPORT_NAME
+	case features.HasInitFlags(unix.FAN_REPORT_FID):
+		return unix.FAN_REPORT_FID
+	default:
+		return 0
 	}
-	// if none of these flags were specified then the basic option
-	// works on any kernel version
-	return true
 }
 
-func fanotifyEventOK(meta *unix.FanotifyEventMetadata, n int) bool {
-	return (n >= int(sizeOfFanotifyEventMetadata) &&
-		meta.Event_len >= sizeOfFanotifyEventMetadata &&
-		int(meta.Event_len) <= n)
+// unprivilegedOptionsValid checks the options of an unprivileged listener. Without
+// CAP_SYS_ADMIN fanotify permits notification groups reporting file identifiers
+// with inode marks only.
+func unprivilegedOptionsValid(opts options) error {
+	const adminReportFlags = unix.FAN_REPORT_TID | unix.FAN_REPORT_PIDFD
+	switch {
+	case opts.permType != PermissionNone:
+		return fmt.Errorf("%w: permission events are not permitted in unprivileged mode", ErrCapSysAdmin)
+	case opts.entireMount:
+		return fmt.Errorf("%w: mount and filesystem marks are not permitted in unprivileged mode", ErrCapSysAdmin)
+	case opts.enableAudit:
+		return fmt.Errorf("%w: audit is not permitted in unprivileged mode", ErrCapSysAdmin)
+	case opts.unlimitedQueue || opts.unlimitedMarks:
+		return fmt.Errorf("%w: unlimited queue and marks are not permitted in unprivileged mode", ErrCapSysAdmin)
+	case (opts.reportFlags|opts.extraReportFlags)&adminReportFlags != 0:
+		return fmt.Errorf("%w: thread IDs and pidfds are not reported in unprivileged mode", ErrCapSysAdmin)
+	case opts.reportFlagsSet && opts.reportFlags&(unix.FAN_REPORT_FID|unix.FAN_REPORT_DIR_FID) == 0:
+		return fmt.Errorf("%w: unprivileged listeners must report file identifiers", ErrInvalidFlagCombination)
+	}
+	return nil
 }
 
-// permissionType is ignored when isNotificationListener is true.
-func newListener(mountpointPath string, entireMount bool, notificationOnly bool, permissionType PermissionType) (*Listener, error) {
+func newListener(mountpointPath string, opts options) (*Listener, error) {
 
 	var flags, eventFlags uint
 
-	maj, min, _, err := kernelVersion()
+	features, err := Features()
 	if err != nil {
 		return nil, err
 	}
-	if !notificationOnly {
+	if opts.unprivileged {
+		if err := unprivilegedOptionsValid(opts); err != nil {
+			return nil, err
+		}
+	}
+	notificationOnly := true
+	switch opts.permType {
+	case PermissionNone:
+		flags = unix.FAN_CLASS_NOTIF
+	case PreContent:
 		// permission + notification events; cannot have FID with this.
-		switch permissionType {
-		case PreContent:
-			flags = unix.FAN_CLASS_PRE_CONTENT | unix.FAN_CLOEXEC
-		case PostContent:
-			flags = unix.FAN_CLASS_CONTENT | unix.FAN_CLOEXEC
-		default:
-			return nil, os.ErrInvalid
+		flags = unix.FAN_CLASS_PRE_CONTENT
+		notificationOnly = false
+	case PostContent:
+		flags = unix.FAN_CLASS_CONTENT
+		notificationOnly = false
+	default:
+		return nil, os.ErrInvalid
+	}
+	if opts.reportFlagsSet {
+		if opts.reportFlags&^reportFlagsMask != 0 {
+			return nil, fmt.Errorf("%w: unknown report flags %#x", ErrInvalidFlagCombination, opts.reportFlags&^reportFlagsMask)
 		}
+		flags |= opts.reportFlags
+	} else if notificationOnly {
+		flags |= defaultReportFlags(features, opts.entireMount)
+	}
+	flags |= opts.extraReportFlags
+	if opts.readWrite {
+		eventFlags = unix.O_RDWR
 	} else {
-		switch {
-		case maj < 5:
-			flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC
-		case maj == 5:
-			if min < 1 {
-				flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC
-			}
-			if min >= 1 && min < 9 {
-				flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_REPORT_FID
-			}
-			if min >= 9 {
-				flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_REPORT_DIR_FID | unix.FAN_REPORT_NAME
-			}
-		case maj > 5:
-			flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC | unix.FAN_REPORT_DIR_FID | unix.FAN_REPORT_NAME
-		}
-		// FAN_MARK_MOUNT cannot be specified with FAN_REPORT_FID, FAN_REPORT_DIR_FID, FAN_REPORT_NAME
-		if entireMount {
-			flags = unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC
-		}
+		eventFlags = unix.O_RDONLY
+	}
+	eventFlags |= unix.O_LARGEFILE
+	if opts.noAtime {
+		eventFlags |= unix.O_NOATIME
+	}
+	if opts.unlimitedQueue {
+		flags |= unix.FAN_UNLIMITED_QUEUE
+	}
+	if opts.unlimitedMarks {
+		flags |= unix.FAN_UNLIMITED_MARKS
+	}
+	if opts.enableAudit {
+		flags |= unix.FAN_ENABLE_AUDIT
+	}
+	if opts.closeOnExec {
+		flags |= unix.FAN_CLOEXEC
+		eventFlags |= unix.O_CLOEXEC
+	}
+	if opts.eventBufferSize < 0 || opts.permissionBufferSize < 0 || opts.errorBufferSize < 0 || opts.permissionTimeout < 0 {
+		return nil, os.ErrInvalid
 	}
-	eventFlags = unix.O_RDONLY | unix.O_LARGEFILE | unix.O_CLOEXEC
 	if err := flagsValid(flags); err != nil {
 		return nil, fmt.Errorf("%w: %v", ErrInvalidFlagCombination, err)
 	}
-	if !fanotifyInitFlagsKernelSupport(flags, maj, min) {
-		panic("some of the flags specified are not supported on the current kernel; refer to the documentation")
+	if err := fanotifyInitFlagsKernelSupport(flags, features); err != nil {
+		return nil, err
+	}
+	if opts.permissionTimeout > 0 {
+		if err := checkDecision(flags, features, opts.timeoutDecision); err != nil {
+			return nil, err
+		}
 	}
 	fd, err := unix.FanotifyInit(flags, eventFlags)
 	if err != nil {
+		if opts.unprivileged && err == unix.EPERM {
+			return nil, fmt.Errorf("%w: unprivileged fanotify requires Linux kernel 5.13 or later", ErrUnsupportedOnKernelVersion)
+		}
 		return nil, err
 	}
 	mountpoint, err := os.Open(mountpointPath)
 	if err != nil {
+		unix.Close(fd)
 		return nil, fmt.Errorf("error opening mount point %s: %w", mountpointPath, err)
 	}
-	r, w, err := os.Pipe()
-	if err != nil {
+	var stopper [2]int
+	if err := unix.Pipe2(stopper[:], unix.O_NONBLOCK|unix.O_CLOEXEC); err != nil {
+		unix.Close(fd)
+		mountpoint.Close()
 		return nil, fmt.Errorf("cannot create stopper pipe: %v", err)
 	}
-	rfdFlags, err := unix.FcntlInt(r.Fd(), unix.F_GETFL, 0)
-	if err != nil {
-		return nil, fmt.Errorf("stopper error: cannot read fd flags: %v", err)
-	}
-	_, err = unix.FcntlInt(r.Fd(), unix.F_SETFL, rfdFlags|unix.O_NONBLOCK)
-	if err != nil {
-		return nil, fmt.Errorf("stopper error: cannot set fd to non-blocking: %v", err)
-	}
 	listener := &Listener{
-		fd:                 fd,
-		flags:              flags,
-		mountpoint:         mountpoint,
-		kernelMajorVersion: maj,
-		kernelMinorVersion: min,
-		entireMount:        entireMount,
-		notificationOnly:   notificationOnly,
-		watches:            make(map[string]bool),
+		fd:                fd,
+		flags:             flags,
+		eventFlags:        eventFlags,
+		mountpoint:        mountpoint,
+		features:          features,
+		entireMount:       opts.entireMount,
+		notificationOnly:  notificationOnly,
+		unprivileged:      opts.unprivileged,
+		handles:           make(map[string]string),
+		watches:           make(map[markKey]bool),
+		recursive:         make(map[string]*recursiveDir),
+		permissionTimeout: opts.permissionTimeout,
+		timeoutDecision:   opts.timeoutDecision,
+		pending:           make(map[int]*pendingPermission),
+		decisionReporter:  opts.decisionReporter,
+		autoClose:         opts.autoClose,
+		fds:               make(map[int]uint64),
 		stopper: struct {
-			r *os.File
-			w *os.File
-		}{r, w},
-		Events:           make(chan Event, 4096),
-		PermissionEvents: make(chan Event, 4096),
+			r int
+			w int
+		}{stopper[0], stopper[1]},
+		done:             make(chan struct{}),
+		Events:           make(chan Event, opts.eventBufferSize),
+		PermissionEvents: make(chan Event, opts.permissionBufferSize),
+		Errors:           make(chan error, opts.errorBufferSize),
+	}
+	if opts.allowCache {
+		listener.allowCache = newAllowCache()
 	}
 	return listener, nil
 }
@@ -296,186 +333,638 @@ func (l *Listener) fanotifyMark(path string, flags uint, mask uint64) error {
 		panic("nil listener")
 	}
 	skip := true
-	if !fanotifyMarkFlagsKernelSupport(mask, l.kernelMajorVersion, l.kernelMinorVersion) {
-		panic("some of the mark mask combinations specified are not supported on the current kernel; refer to the documentation")
+	if err := fanotifyMarkFlagsKernelSupport(mask, l.features); err != nil {
+		return err
+	}
+	if err := fanotifyMarkTypeKernelSupport(flags, l.features); err != nil {
+		return err
 	}
-	if err := isFanotifyMarkMaskValid(flags, mask); err != nil {
+	if err := isFanotifyMarkMaskValid(l.flags, flags, mask); err != nil {
 		return fmt.Errorf("%v: %w", err, ErrInvalidFlagCombination)
 	}
+	if l.unprivileged && flags&markTypeMask != 0 {
+		return fmt.Errorf("%w: mount and filesystem marks are not permitted in unprivileged mode", ErrCapSysAdmin)
+	}
 	remove := flags&unix.FAN_MARK_REMOVE == unix.FAN_MARK_REMOVE
-	_, found := l.watches[path]
+	key := markKey{path: path, markType: flags & (markTypeMask | ignoreMask)}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return ErrListenerStopped
+	}
+	_, found := l.watches[key]
 	if found {
 		if remove {
-			delete(l.watches, path)
 			skip = false
 		}
 	} else {
 		if !remove {
-			l.watches[path] = true
 			skip = false
 		}
 	}
 	if !skip {
 		if err := unix.FanotifyMark(l.fd, flags, mask, -1, path); err != nil {
+			if err == unix.ENOSPC {
+				return fmt.Errorf("%w: %s", ErrMarkLimit, path)
+			}
 			return err
 		}
+		if remove {
+			delete(l.watches, key)
+		} else {
+			l.watches[key] = true
+		}
+		if l.unprivileged && key.markType == 0 {
+			if remove {
+				l.forgetHandle(path)
+			} else {
+				l.rememberHandle(path)
+			}
+		}
 	}
 	return nil
 }
 
-func getFileHandle(metadataLen uint16, buf []byte, i int) *unix.FileHandle {
-	var fhSize uint32 // this is unsigned int handle_bytes; but Go uses uint32
-	var fhType int32  // this is int handle_type; but Go uses int32
-
-	sizeOfFanotifyEventInfoHeader := uint32(unsafe.Sizeof(fanotifyEventInfoHeader{}))
-	sizeOfKernelFSIDType := uint32(unsafe.Sizeof(unix.Fsid{}))
-	sizeOfUint32 := uint32(unsafe.Sizeof(fhSize))
-	j := uint32(i) + uint32(metadataLen) + sizeOfFanotifyEventInfoHeader + sizeOfKernelFSIDType
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhSize)
-	j += sizeOfUint32
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhType)
-	j += sizeOfUint32
-	handle := unix.NewFileHandle(fhType, buf[j:j+fhSize])
-	return &handle
-}
-
-func getFileHandleWithName(metadataLen uint16, buf []byte, i int) (*unix.FileHandle, string) {
-	var fhSize uint32
-	var fhType int32
-	var fname string
-	var nameBytes bytes.Buffer
-
-	sizeOfFanotifyEventInfoHeader := uint32(unsafe.Sizeof(fanotifyEventInfoHeader{}))
-	sizeOfKernelFSIDType := uint32(unsafe.Sizeof(unix.Fsid{}))
-	sizeOfUint32 := uint32(unsafe.Sizeof(fhSize))
-	j := uint32(i) + uint32(metadataLen) + sizeOfFanotifyEventInfoHeader + sizeOfKernelFSIDType
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhSize)
-	j += sizeOfUint32
-	binary.Read(bytes.NewReader(buf[j:j+sizeOfUint32]), binary.LittleEndian, &fhType)
-	j += sizeOfUint32
-	handle := unix.NewFileHandle(fhType, buf[j:j+fhSize])
-	j += fhSize
-	// stop when NULL byte is read to get the filename
-	for i := j; i < j+unix.NAME_MAX; i++ {
-		if buf[i] == 0 {
-			break
+// ignoreMark returns the mark flags and mask to update the ignore mask of the path.
+// FAN_MARK_IGNORE (Linux 6.0+) is preferred as it applies to directories and their
+// children; otherwise the legacy FAN_MARK_IGNORED_MASK is used.
+func (l *Listener) ignoreMark(path string, eventTypes EventType) (uint, uint64) {
+	mask := uint64(eventTypes)
+	if !l.features.HasMarkFlags(fanMarkIgnore) {
+		// event flags have no effect with FAN_MARK_IGNORED_MASK
+		return unix.FAN_MARK_IGNORED_MASK, mask &^ (unix.FAN_ONDIR | unix.FAN_EVENT_ON_CHILD)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		mask |= unix.FAN_EVENT_ON_CHILD
+	}
+	return fanMarkIgnore, mask
+}
+
+// openHandle opens the file handle relative to the mount point and returns
+// the file descriptor and its path.
+func (l *Listener) openHandle(handle *unix.FileHandle) (int, string, error) {
+	var name [unix.PathMax]byte
+
+	fd, err := unix.OpenByHandleAt(int(l.mountpoint.Fd()), *handle, unix.O_RDONLY)
+	if err != nil {
+		return -1, "", fmt.Errorf("open_by_handle_at: %w", err)
+	}
+	fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
+	n, err := unix.Readlink(fdPath, name[:])
+	if err != nil {
+		unix.Close(fd)
+		return -1, "", fmt.Errorf("readlink %s: %w", fdPath, err)
+	}
+	return fd, string(name[:n]), nil
+}
+
+// resolveHandle returns the file descriptor and the path of the object identified
+// by the file identifier record. Unprivileged listeners cannot open file handles;
+// the path is looked up in the handles of the marked paths and no file descriptor
+// is returned.
+func (l *Listener) resolveHandle(record InfoRecord) (int, string, error) {
+	if !l.unprivileged {
+		return l.openHandle(record.Handle)
+	}
+	l.mu.Lock()
+	path, found := l.handles[handleKey(record.Fsid, record.Handle)]
+	l.mu.Unlock()
+	if !found {
+		return unix.FAN_NOFD, "", fmt.Errorf("%w: file handle of an unmarked object cannot be resolved in unprivileged mode", errMalformedEvent)
+	}
+	return unix.FAN_NOFD, path, nil
+}
+
+// handleKey identifies a file handle within the filesystem identified by fsid
+func handleKey(fsid unix.Fsid, handle *unix.FileHandle) string {
+	return fmt.Sprintf("%x.%x:%x:%x", uint32(fsid.Val[0]), uint32(fsid.Val[1]), handle.Type(), handle.Bytes())
+}
+
+// rememberHandle records the file handle of the marked path. It must be called
+// with l.mu held.
+func (l *Listener) rememberHandle(path string) {
+	var stat unix.Statfs_t
+
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, unix.AT_SYMLINK_FOLLOW)
+	if err != nil {
+		return
+	}
+	if err := unix.Statfs(path, &stat); err != nil {
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	l.handles[handleKey(stat.Fsid, &handle)] = path
+}
+
+// forgetHandle removes the file handle of the unmarked path. It must be called
+// with l.mu held.
+func (l *Listener) forgetHandle(path string) {
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	for key, p := range l.handles {
+		if p == path {
+			delete(l.handles, key)
 		}
-		nameBytes.WriteByte(buf[i])
 	}
-	if nameBytes.Len() != 0 {
-		fname = nameBytes.String()
+}
+
+// parseInfoRecords decodes the information records in buf, which holds the bytes
+// of an event following its metadata.
+func parseInfoRecords(buf []byte) ([]InfoRecord, error) {
+	var records []InfoRecord
+
+	sizeOfFanotifyEventInfoHeader := int(unsafe.Sizeof(fanotifyEventInfoHeader{}))
+	for len(buf) > 0 {
+		var header fanotifyEventInfoHeader
+		if len(buf) < sizeOfFanotifyEventInfoHeader {
+			return records, fmt.Errorf("%w: truncated info record header", errMalformedEvent)
+		}
+		header.InfoType = buf[0]
+		header.Len = binary.LittleEndian.Uint16(buf[2:4])
+		if int(header.Len) < sizeOfFanotifyEventInfoHeader || int(header.Len) > len(buf) {
+			return records, fmt.Errorf("%w: info record length %d out of range", errMalformedEvent, header.Len)
+		}
+		record, err := parseInfoRecord(InfoType(header.InfoType), buf[sizeOfFanotifyEventInfoHeader:header.Len])
+		if err != nil {
+			return records, err
+		}
+		records = append(records, record)
+		buf = buf[header.Len:]
 	}
-	return &handle, fname
+	return records, nil
 }
 
-func (l *Listener) readEvents() error {
-	var fid *fanotifyEventInfoFID
-	var metadata *unix.FanotifyEventMetadata
-	var buf [4096 * sizeOfFanotifyEventMetadata]byte
+// parseInfoRecord decodes the body of a single information record following its header.
+func parseInfoRecord(infoType InfoType, body []byte) (InfoRecord, error) {
+	record := InfoRecord{Type: infoType, Pidfd: -1}
+	switch infoType {
+	case InfoFID, InfoDFID, InfoDFIDName, InfoOldDFIDName, InfoNewDFIDName:
+		// __kernel_fsid_t fsid; struct file_handle handle; [char name[]]
+		if len(body) < 16 {
+			return record, fmt.Errorf("%w: truncated file identifier record", errMalformedEvent)
+		}
+		record.Fsid.Val[0] = int32(binary.LittleEndian.Uint32(body[0:4]))
+		record.Fsid.Val[1] = int32(binary.LittleEndian.Uint32(body[4:8]))
+		fhSize := binary.LittleEndian.Uint32(body[8:12])
+		fhType := int32(binary.LittleEndian.Uint32(body[12:16]))
+		if uint32(len(body)-16) < fhSize {
+			return record, fmt.Errorf("%w: file handle size %d out of range", errMalformedEvent, fhSize)
+		}
+		handle := unix.NewFileHandle(fhType, body[16:16+fhSize])
+		record.Handle = &handle
+		if infoType == InfoDFIDName || infoType == InfoOldDFIDName || infoType == InfoNewDFIDName {
+			name := body[16+fhSize:]
+			if k := bytes.IndexByte(name, 0); k >= 0 {
+				name = name[:k]
+			}
+			record.Name = string(name)
+		}
+	case InfoPIDFD:
+		// __s32 pidfd
+		if len(body) < 4 {
+			return record, fmt.Errorf("%w: truncated pidfd record", errMalformedEvent)
+		}
+		record.Pidfd = int(int32(binary.LittleEndian.Uint32(body[0:4])))
+	case InfoError:
+		// __s32 error; __u32 error_count
+		if len(body) < 8 {
+			return record, fmt.Errorf("%w: truncated error record", errMalformedEvent)
+		}
+		record.Error = int32(binary.LittleEndian.Uint32(body[0:4]))
+		record.ErrorCount = binary.LittleEndian.Uint32(body[4:8])
+	case InfoRange:
+		// __u32 pad; __u64 offset; __u64 count
+		if len(body) < 20 {
+			return record, fmt.Errorf("%w: truncated range record", errMalformedEvent)
+		}
+		record.Offset = int64(binary.LittleEndian.Uint64(body[4:12]))
+		record.Count = int64(binary.LittleEndian.Uint64(body[12:20]))
+	}
+	return record, nil
+}
+
+// closeFds closes the file descriptors the kernel or the listener opened for
+// an event that is not delivered.
+func (e *Event) closeFds() {
+	e.Close()
+	if e.Process != nil {
+		e.Process.Close()
+		return
+	}
+	for _, record := range e.Info {
+		if record.Type == InfoPIDFD && record.Pidfd >= 0 {
+			unix.Close(record.Pidfd)
+		}
+	}
+}
+
+// newEvent decodes the event from buf holding the event metadata followed by
+// its information records. The file descriptor of the event refers to the
+// object described by the first file identifier record when the listener
+// reports file identifiers.
+func (l *Listener) newEvent(metadata *unix.FanotifyEventMetadata, buf []byte) (Event, error) {
 	var name [unix.PathMax]byte
-	var fileHandle *unix.FileHandle
-	var fileName string
 
+	mask := metadata.Mask
+	if mask&unix.FAN_ONDIR == unix.FAN_ONDIR {
+		mask = mask ^ unix.FAN_ONDIR
+	}
+	event := Event{
+		Fd:         int(metadata.Fd),
+		EventTypes: EventType(mask),
+		Pid:        int(metadata.Pid),
+	}
+	if l.flags&unix.FAN_REPORT_TID == unix.FAN_REPORT_TID {
+		event.Tid = int(metadata.Pid)
+	}
+	if mask&unix.FAN_Q_OVERFLOW == unix.FAN_Q_OVERFLOW {
+		// overflow events carry neither a file descriptor nor an info record
+		event.Fd = unix.FAN_NOFD
+		event.EventTypes = QueueOverflow
+		return event, nil
+	}
+	records, err := parseInfoRecords(buf[metadata.Metadata_len:])
+	event.Info = records
+	if err != nil {
+		event.closeFds()
+		return Event{}, err
+	}
+	for _, record := range records {
+		switch record.Type {
+		case InfoPIDFD:
+			event.Process = &Process{Pid: event.Pid, Pidfd: record.Pidfd}
+		case InfoRange:
+			event.Range = &FileRange{Offset: record.Offset, Count: record.Count}
+		}
+	}
+	if mask&unix.FAN_FS_ERROR == unix.FAN_FS_ERROR {
+		// the affected file is not opened; it may be corrupted
+		for _, record := range records {
+			switch record.Type {
+			case InfoError:
+				event.Errno = unix.Errno(record.Error)
+				event.ErrorCount = record.ErrorCount
+			case InfoFID:
+				event.FileHandle = record.Handle
+			}
+		}
+		return event, nil
+	}
+	if event.Fd != unix.FAN_NOFD {
+		// no fid (applicable to kernels 5.0 and earlier)
+		procFdPath := fmt.Sprintf("/proc/self/fd/%d", event.Fd)
+		n, err := unix.Readlink(procFdPath, name[:])
+		if err != nil {
+			event.closeFds()
+			return Event{}, fmt.Errorf("readlink %s: %w", procFdPath, err)
+		}
+		event.Path = string(name[:n])
+		return event, nil
+	}
+	// fid (applicable to kernels 5.1+)
+	for _, record := range records {
+		switch record.Type {
+		case InfoOldDFIDName:
+			fd, path, err := l.resolveHandle(record)
+			if err != nil {
+				event.closeFds()
+				return Event{}, err
+			}
+			unix.Close(fd)
+			event.OldPath = path
+			event.OldFileName = record.Name
+		case InfoNewDFIDName:
+			fd, path, err := l.resolveHandle(record)
+			if err != nil {
+				event.closeFds()
+				return Event{}, err
+			}
+			if event.Fd != unix.FAN_NOFD {
+				unix.Close(event.Fd)
+			}
+			event.Fd = fd
+			event.NewPath = path
+			event.NewFileName = record.Name
+			event.Path = path
+			event.FileName = record.Name
+		case InfoFID, InfoDFID, InfoDFIDName:
+			if event.Fd != unix.FAN_NOFD {
+				continue
+			}
+			fd, path, err := l.resolveHandle(record)
+			if err != nil {
+				event.closeFds()
+				return Event{}, err
+			}
+			event.Fd = fd
+			event.Path = path
+			event.FileName = record.Name
+		}
+	}
+	return event, nil
+}
+
+// acquire registers a runner of the poll loop. It returns false if the listener
+// has been stopped.
+func (l *Listener) acquire() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return false
+	}
+	l.wg.Add(1)
+	return true
+}
+
+// wakeup unblocks the poll loop by writing to the stopper pipe.
+func (l *Listener) wakeup() {
+	unix.Write(l.stopper.w, []byte("stop"))
+}
+
+// drainStopper discards pending wakeups from the non-blocking stopper pipe.
+func (l *Listener) drainStopper() {
+	var buf [64]byte
 	for {
-		n, err := unix.Read(l.fd, buf[:])
-		if err == unix.EINTR {
-			continue
+		n, err := unix.Read(l.stopper.r, buf[:])
+		if n <= 0 || err != nil {
+			return
+		}
+	}
+}
+
+// reportError pushes a non-fatal error into the Errors channel without blocking.
+func (l *Listener) reportError(err error) {
+	select {
+	case l.Errors <- err:
+	default:
+	}
+}
+
+// reportAsyncError reports an error from outside the poll loop, where the Errors
+// channel may be closed by a concurrent Stop.
+func (l *Listener) reportAsyncError(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.stopped {
+		l.reportError(err)
+	}
+}
+
+// send delivers the event on the channel. It returns false without delivering the
+// event if the listener is stopped or the context is done while waiting.
+func (l *Listener) send(ctx context.Context, ch chan Event, event Event) bool {
+	select {
+	case ch <- event:
+		return true
+	case <-l.done:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (l *Listener) run(ctx context.Context) error {
+	var fds [2]unix.PollFd
+
+	l.drainStopper()
+	// wake the poll loop when the context is cancelled
+	exit := make(chan struct{})
+	exited := make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			l.wakeup()
+		case <-exit:
 		}
+	}()
+	defer func() {
+		close(exit)
+		<-exited
+	}()
+	// Fanotify Fd
+	fds[0].Fd = int32(l.fd)
+	fds[0].Events = unix.POLLIN
+	// Stopper/Cancellation Fd
+	fds[1].Fd = int32(l.stopper.r)
+	fds[1].Events = unix.POLLIN
+	for {
+		n, err := unix.Poll(fds[:], -1)
 		if err != nil {
-			return err
+			if err == unix.EINTR {
+				continue
+			}
+			return fmt.Errorf("poll: %w", err)
 		}
-		if n == 0 || n < int(sizeOfFanotifyEventMetadata) {
-			break
+		if n == 0 {
+			continue
 		}
-		i := 0
-		metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-		for fanotifyEventOK(metadata, n) {
-			if metadata.Vers != unix.FANOTIFY_METADATA_VERSION {
-				panic("metadata structure from the kernel does not match the structure definition at compile time")
+		if fds[1].Revents != 0 {
+			if fds[1].Revents&unix.POLLIN == unix.POLLIN {
+				// found data on the stopper
+				l.drainStopper()
+				return ctx.Err()
 			}
-			if metadata.Fd != unix.FAN_NOFD {
-				// no fid (applicable to kernels 5.0 and earlier)
-				procFdPath := fmt.Sprintf("/proc/self/fd/%d", metadata.Fd)
-				n1, err := unix.Readlink(procFdPath, name[:])
-				if err != nil {
-					i += int(metadata.Event_len)
-					n -= int(metadata.Event_len)
-					metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-					continue
-				}
-				mask := metadata.Mask
-				if mask&unix.FAN_ONDIR == unix.FAN_ONDIR {
-					mask = mask ^ unix.FAN_ONDIR
-				}
-				event := Event{
-					Fd:         int(metadata.Fd),
-					Path:       string(name[:n1]),
-					EventTypes: EventType(mask),
-					Pid:        int(metadata.Pid),
-				}
-				if mask&unix.FAN_ACCESS_PERM == unix.FAN_ACCESS_PERM ||
-					mask&unix.FAN_OPEN_PERM == unix.FAN_OPEN_PERM ||
-					mask&unix.FAN_OPEN_EXEC_PERM == unix.FAN_OPEN_EXEC_PERM {
-					l.PermissionEvents <- event
-				} else {
-					l.Events <- event
-				}
-				i += int(metadata.Event_len)
-				n -= int(metadata.Event_len)
-				metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-			} else {
-				// fid (applicable to kernels 5.1+)
-				fid = (*fanotifyEventInfoFID)(unsafe.Pointer(&buf[i+int(metadata.Metadata_len)]))
-				withName := false
-				switch {
-				case fid.Header.InfoType == unix.FAN_EVENT_INFO_TYPE_FID:
-					withName = false
-				case fid.Header.InfoType == unix.FAN_EVENT_INFO_TYPE_DFID:
-					withName = false
-				case fid.Header.InfoType == unix.FAN_EVENT_INFO_TYPE_DFID_NAME:
-					withName = true
-				default:
-					i += int(metadata.Event_len)
-					n -= int(metadata.Event_len)
-					metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-					continue
-				}
-				if withName {
-					fileHandle, fileName = getFileHandleWithName(metadata.Metadata_len, buf[:], i)
-					i += len(fileName) // advance some to cover the filename
-				} else {
-					fileHandle = getFileHandle(metadata.Metadata_len, buf[:], i)
-				}
-				fd, errno := unix.OpenByHandleAt(int(l.mountpoint.Fd()), *fileHandle, unix.O_RDONLY)
-				if errno != nil {
-					// log.Println("OpenByHandleAt:", errno)
-					i += int(metadata.Event_len)
-					n -= int(metadata.Event_len)
-					metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
-					continue
-				}
-				fdPath := fmt.Sprintf("/proc/self/fd/%d", fd)
-				n1, _ := unix.Readlink(fdPath, name[:]) // TODO handle err case
-				pathName := string(name[:n1])
-				mask := metadata.Mask
-				if mask&unix.FAN_ONDIR == unix.FAN_ONDIR {
-					mask = mask ^ unix.FAN_ONDIR
+		}
+		if fds[0].Revents != 0 {
+			if fds[0].Revents&unix.POLLIN == unix.POLLIN {
+				// blocks when the channel bufferred is full
+				if err := l.readEvents(ctx); err != nil {
+					return err
 				}
-				event := Event{
-					Fd:         fd,
-					Path:       pathName,
-					FileName:   fileName,
-					EventTypes: EventType(mask),
-					Pid:        int(metadata.Pid),
+				if !l.running(ctx) {
+					return ctx.Err()
 				}
-				// As of the kernel release (6.0) permission events cannot have FID flags.
-				// So the event here is always a notification event
-				l.Events <- event
-				i += int(metadata.Event_len)
-				n -= int(metadata.Event_len)
-				metadata = (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
 			}
 		}
 	}
+}
+
+// running returns false once the listener is stopped or the context is done.
+func (l *Listener) running(ctx context.Context) bool {
+	select {
+	case <-l.done:
+		return false
+	case <-ctx.Done():
+		return false
+	default:
+		return true
+	}
+}
+
+// readEvents reads the pending events from the notification group once and
+// delivers them to the Events or PermissionEvents channel.
+func (l *Listener) readEvents(ctx context.Context) error {
+	var buf [4096 * sizeOfFanotifyEventMetadata]byte
+
+	n, err := unix.Read(l.fd, buf[:])
+	for err == unix.EINTR {
+		n, err = unix.Read(l.fd, buf[:])
+	}
+	if err != nil {
+		return fmt.Errorf("read: %w", err)
+	}
+	for i := 0; n-i >= int(sizeOfFanotifyEventMetadata); {
+		metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
+		if !fanotifyEventOK(metadata, n-i) || metadata.Metadata_len < uint16(sizeOfFanotifyEventMetadata) {
+			break
+		}
+		if metadata.Vers != unix.FANOTIFY_METADATA_VERSION {
+			l.dropEvents(buf[i:n])
+			return fmt.Errorf("%w: event metadata version %d, expected %d", ErrUnsupportedOnKernelVersion, metadata.Vers, unix.FANOTIFY_METADATA_VERSION)
+		}
+		event, err := l.newEvent(metadata, buf[i:i+int(metadata.Event_len)])
+		i += int(metadata.Event_len)
+		if err != nil {
+			l.reportError(err)
+			continue
+		}
+		if !l.handleRecursive(metadata.Mask, &event) {
+			event.closeFds()
+			continue
+		}
+		l.ownFd(&event)
+		ch := l.Events
+		if isPermissionEvent(event.EventTypes) {
+			ch = l.PermissionEvents
+			l.trackPermission(&event)
+		}
+		if !l.send(ctx, ch, event) {
+			l.dropEvent(event)
+			l.dropEvents(buf[i:n])
+			return nil
+		}
+	}
+	return nil
+}
+
+// dropEvent closes the file descriptors of an event that is not delivered.
+// Permission events are allowed first, as the kernel does when the notification
+// group is closed, since the listener may keep running after [Listener.Run]
+// returned and the access would stay blocked otherwise.
+func (l *Listener) dropEvent(event Event) {
+	// events that timed out already received the default decision
+	if l.claimPermission(event) == nil && isPermissionEvent(event.EventTypes) && event.Fd >= 0 {
+		writeResponse(l.fd, event.Fd, Allow, nil)
+	}
+	event.closeFds()
+}
+
+// dropEvents drops the events left in buf once the events read can no longer be
+// delivered. Only the fields common to all metadata versions are decoded.
+func (l *Listener) dropEvents(buf []byte) {
+	for i := 0; len(buf)-i >= int(sizeOfFanotifyEventMetadata); {
+		metadata := (*unix.FanotifyEventMetadata)(unsafe.Pointer(&buf[i]))
+		if !fanotifyEventOK(metadata, len(buf)-i) || metadata.Metadata_len < uint16(sizeOfFanotifyEventMetadata) {
+			return
+		}
+		event := Event{Fd: int(metadata.Fd), EventTypes: EventType(metadata.Mask)}
+		if metadata.Mask&unix.FAN_Q_OVERFLOW == 0 && uint32(metadata.Metadata_len) <= metadata.Event_len {
+			event.Info, _ = parseInfoRecords(buf[i+int(metadata.Metadata_len) : i+int(metadata.Event_len)])
+		}
+		i += int(metadata.Event_len)
+		if isPermissionEvent(event.EventTypes) && event.Fd >= 0 {
+			writeResponse(l.fd, event.Fd, Allow, nil)
+		}
+		event.closeFds()
+	}
+}
+
+// decisionValid returns an error if the decision cannot be sent by any listener
+func decisionValid(d Decision) error {
+	if base := d & (unix.FAN_ALLOW | unix.FAN_DENY); base != unix.FAN_ALLOW && base != unix.FAN_DENY {
+		return fmt.Errorf("%w: decision %#x is neither Allow nor Deny", ErrInvalidFlagCombination, uint32(d))
+	}
+	if unknown := d &^ (unix.FAN_ALLOW | unix.FAN_DENY | unix.FAN_AUDIT | 0xff<<fanDenyErrnoShift); unknown != 0 {
+		return fmt.Errorf("%w: unknown decision flags %#x", ErrInvalidFlagCombination, uint32(unknown))
+	}
+	return nil
+}
+
+// checkDecision returns an error if the decision cannot be sent by a listener
+// created with the fanotify_init flags on a kernel with the features
+func checkDecision(flags uint, features FeatureSet, d Decision) error {
+	if err := decisionValid(d); err != nil {
+		return err
+	}
+	if d&unix.FAN_AUDIT != 0 && flags&unix.FAN_ENABLE_AUDIT == 0 {
+		return fmt.Errorf("%w: audit requires a listener created with WithEnableAudit", ErrInvalidFlagCombination)
+	}
+	errno := unix.Errno(d >> fanDenyErrnoShift)
+	if errno == 0 {
+		return nil
+	}
+	if d&(unix.FAN_ALLOW|unix.FAN_DENY) != unix.FAN_DENY {
+		return fmt.Errorf("%w: an errno can only be returned by a denial", ErrInvalidFlagCombination)
+	}
+	switch errno {
+	case unix.EPERM, unix.EIO, unix.EBUSY, unix.ETXTBSY, unix.EAGAIN, unix.ENOSPC, unix.EDQUOT:
+	default:
+		return fmt.Errorf("%w: errno %d (%v) cannot be returned by a denial", ErrInvalidFlagCombination, errno, errno)
+	}
+	if flags&unix.FAN_CLASS_PRE_CONTENT != unix.FAN_CLASS_PRE_CONTENT {
+		return fmt.Errorf("%w: an errno can only be returned by PreContent listeners", ErrInvalidFlagCombination)
+	}
+	if !features.DenyErrno {
+		return fmt.Errorf("%w: denying with an errno requires Linux kernel 6.14 or later", ErrUnsupportedOnKernelVersion)
+	}
 	return nil
 }
+
+// auditRuleInfo encodes the audit rule as an information record of a permission response
+func auditRuleInfo(rule AuditRule) []byte {
+	info := fanotifyResponseInfoAuditRule{
+		Type:       fanResponseInfoAuditRule,
+		RuleNumber: rule.RuleNumber,
+		SubjTrust:  rule.SubjectTrust,
+		ObjTrust:   rule.ObjectTrust,
+	}
+	info.Len = uint16(unsafe.Sizeof(info))
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, &info)
+	return buf.Bytes()
+}
+
+// sendResponse writes the response unless the listener is stopped. The response is
+// written with l.mu held so that Stop cannot close the notification group, whose
+// file descriptor may then be reused, in the meantime.
+func (l *Listener) sendResponse(fd int, d Decision, info []byte) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return ErrListenerStopped
+	}
+	return writeResponse(l.fd, fd, d, info)
+}
+
+// writeResponse writes the response to the permission event of the file descriptor
+// to the notification group, followed by the information records in info.
+func writeResponse(group, fd int, d Decision, info []byte) error {
+	response := unix.FanotifyResponse{Fd: int32(fd), Response: uint32(d)}
+	if len(info) > 0 {
+		response.Response |= fanInfo
+	}
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, &response); err != nil {
+		return err
+	}
+	buf.Write(info)
+	n, err := unix.Write(group, buf.Bytes())
+	for err == unix.EINTR {
+		n, err = unix.Write(group, buf.Bytes())
+	}
+	if err != nil {
+		return fmt.Errorf("write response: %w", err)
+	}
+	if n != buf.Len() {
+		return fmt.Errorf("write response: %w", io.ErrShortWrite)
+	}
+	return nil
+}
+
+// isPermissionEvent returns true if the event requires a response
+func isPermissionEvent(eventTypes EventType) bool {
+	return eventTypes&(unix.FAN_ACCESS_PERM|unix.FAN_OPEN_PERM|unix.FAN_OPEN_EXEC_PERM|fanPreAccess) != 0
+}
@@ -88,6 +88,16 @@ const (
 	// Requires Linux kernel 5.1 or later (requires FID)
 	WatchedFileOrDirectoryMoved EventType = unix.FAN_MOVE_SELF | unix.FAN_ONDIR
 
+	// FileRenamed event when a file has been renamed within or across the watched directories.
+	// The event holds both the old and the new parent directory and name.
+	// Requires Linux kernel 5.17 or later (requires FID with directory and name)
+	FileRenamed EventType = unix.FAN_RENAME
+
+	// FileOrDirectoryRenamed event when a file or directory has been renamed within or across
+	// the watched directories. The event holds both the old and the new parent directory and name.
+	// Requires Linux kernel 5.17 or later (requires FID with directory and name)
+	FileOrDirectoryRenamed EventType = unix.FAN_RENAME | unix.FAN_ONDIR
+
 	// FileOpenPermission event when a permission to open a file or directory is requested
 	FileOpenPermission EventType = unix.FAN_OPEN_PERM
 
@@ -97,4 +107,21 @@ const (
 
 	// FileAccessPermission event when a permission to read a file or directory is requested
 	FileAccessPermission EventType = unix.FAN_ACCESS_PERM
+
+	// FilePreAccess event before the content of a file is accessed, which gives the listener
+	// the chance to fill the content with [Listener.WriteContent] before allowing the access.
+	// The accessed range is held in Range. Can only be watched by [PreContent] listeners on
+	// filesystems supporting pre-content events.
+	// Requires Linux kernel 6.14 or later
+	FilePreAccess EventType = fanPreAccess
+
+	// FilesystemError event when a filesystem reported an error, for example metadata corruption.
+	// The event holds the errno and the number of errors in Errno and ErrorCount. Can only be
+	// watched on filesystem marks of listeners reporting file identifiers, see [Listener.WatchFilesystem].
+	// Requires Linux kernel 5.16 or later
+	FilesystemError EventType = unix.FAN_FS_ERROR
+
+	// QueueOverflow event when the event queue of the listener exceeded its limit
+	// and further events were lost. The event carries no file descriptor or path.
+	QueueOverflow EventType = unix.FAN_Q_OVERFLOW
 )
@@ -0,0 +1,170 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// eventFd owns the file descriptor of an event. It is shared by the copies of the
+// event so that the descriptor is closed once, whether by [Event.Close],
+// [Listener.Respond] or the *os.File returned by [Event.File]. Its state is guarded
+// by the mu of the listener.
+type eventFd struct {
+	l  *Listener
+	id uint64
+	fd int
+	// dev and ino identify the file to tell a leaked descriptor from a descriptor
+	// closed with unix.Close and reused for another file
+	dev    uint64
+	ino    uint64
+	closed bool
+	file   *os.File
+}
+
+// ownFd registers the file descriptor of the event with the listener until the
+// event is closed. A descriptor still registered for an earlier event was closed
+// directly with unix.Close and reused by the kernel, so the earlier event no
+// longer owns it.
+func (l *Listener) ownFd(event *Event) {
+	var stat unix.Stat_t
+
+	if event.Fd < 0 || unix.Fstat(event.Fd, &stat) != nil {
+		return
+	}
+	l.mu.Lock()
+	l.fdSeq++
+	o := &eventFd{l: l, id: l.fdSeq, fd: event.Fd, dev: stat.Dev, ino: stat.Ino}
+	l.fds[event.Fd] = o.id
+	l.mu.Unlock()
+	runtime.SetFinalizer(o, (*eventFd).finalize)
+	event.owner = o
+}
+
+// LeakedFds returns the number of events that were garbage collected while their
+// file descriptors were still open. Such descriptors are not closed by the listener
+// as they may still be in use through copies of [Event.Fd].
+func (l *Listener) LeakedFds() uint64 {
+	if l == nil {
+		panic("nil listener")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leakedFds
+}
+
+// File returns the file descriptor of the event as an *os.File, which takes over
+// the descriptor: it is closed by the file, by [Event.Close] on any copy of the
+// event, by [Listener.Respond], or by the garbage collector once the file is no
+// longer referenced. Every call returns the same file. The value is nil if the
+// event has no file descriptor or it was already closed.
+func (e Event) File() *os.File {
+	o := e.owner
+	if o == nil {
+		return nil
+	}
+	o.l.mu.Lock()
+	defer o.l.mu.Unlock()
+	if o.closed {
+		return nil
+	}
+	if o.file == nil {
+		if o.reusedLocked() {
+			o.closed = true
+			return nil
+		}
+		delete(o.l.fds, o.fd)
+		o.file = os.NewFile(uintptr(o.fd), eventPath(e))
+	}
+	return o.file
+}
+
+// Close closes the file descriptor of the event. It can be called on any copy of the
+// event and more than once; the descriptor is only closed the first time. The pidfd
+// of [Event.Process] is not closed.
+func (e Event) Close() error {
+	if e.owner == nil {
+		if e.Fd < 0 {
+			return nil
+		}
+		return unix.Close(e.Fd)
+	}
+	e.owner.l.mu.Lock()
+	defer e.owner.l.mu.Unlock()
+	return e.owner.closeLocked()
+}
+
+// closeLocked closes the file descriptor unless it was closed with unix.Close, in
+// which case the number may already belong to another file. It must be called with
+// l.mu held.
+func (o *eventFd) closeLocked() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	if o.file != nil {
+		return o.file.Close()
+	}
+	if o.reusedLocked() {
+		return nil
+	}
+	delete(o.l.fds, o.fd)
+	return unix.Close(o.fd)
+}
+
+// reusedLocked reports whether the file descriptor no longer refers to the file of
+// the event, because it was closed with unix.Close and the number was reused by a
+// later event or by another open. The number is forgotten if it was not reused by
+// an event. A reuse for the same file cannot be told apart and is not detected. It
+// must be called with l.mu held.
+func (o *eventFd) reusedLocked() bool {
+	var stat unix.Stat_t
+
+	if o.l.fds[o.fd] != o.id {
+		return true
+	}
+	if unix.Fstat(o.fd, &stat) != nil || stat.Dev != o.dev || stat.Ino != o.ino {
+		delete(o.l.fds, o.fd)
+		return true
+	}
+	return false
+}
+
+// finalize counts the file descriptor as leaked if it is still open once the
+// event is garbage collected. Descriptors handed to an *os.File are closed by
+// its own finalizer.
+func (o *eventFd) finalize() {
+	l := o.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if o.closed || o.file != nil || o.reusedLocked() {
+		return
+	}
+	delete(l.fds, o.fd)
+	l.leakedFds++
+}
+
+// HandleEvents calls fn for each notification event of the listener until the
+// listener is stopped. For listeners created with [WithAutoClose] the file
+// descriptor and the pidfd of each event are closed once fn returns, so fn must
+// not retain them; otherwise fn is responsible for closing them. HandleEvents must
+// be the only consumer of the Events channel. [os.ErrInvalid] is returned if fn is nil.
+func (l *Listener) HandleEvents(fn func(Event)) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if fn == nil {
+		return os.ErrInvalid
+	}
+	for e := range l.Events {
+		fn(e)
+		if l.autoClose {
+			e.closeFds()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fanotify_init flags available on every kernel supporting fanotify
+	baseInitFlags = unix.FAN_CLOEXEC |
+		unix.FAN_NONBLOCK |
+		unix.FAN_CLASS_NOTIF |
+		unix.FAN_CLASS_CONTENT |
+		unix.FAN_CLASS_PRE_CONTENT |
+		unix.FAN_UNLIMITED_QUEUE |
+		unix.FAN_UNLIMITED_MARKS
+	// fanotify_mark flags available on every kernel supporting fanotify
+	baseMarkFlags = unix.FAN_MARK_ADD |
+		unix.FAN_MARK_REMOVE |
+		unix.FAN_MARK_DONT_FOLLOW |
+		unix.FAN_MARK_ONLYDIR |
+		unix.FAN_MARK_MOUNT |
+		unix.FAN_MARK_IGNORED_MASK |
+		unix.FAN_MARK_IGNORED_SURV_MODIFY |
+		unix.FAN_MARK_FLUSH
+	// events available on every kernel supporting fanotify
+	baseEvents = unix.FAN_ACCESS |
+		unix.FAN_MODIFY |
+		unix.FAN_CLOSE_WRITE |
+		unix.FAN_CLOSE_NOWRITE |
+		unix.FAN_OPEN |
+		unix.FAN_Q_OVERFLOW |
+		unix.FAN_OPEN_PERM |
+		unix.FAN_ACCESS_PERM |
+		unix.FAN_ONDIR |
+		unix.FAN_EVENT_ON_CHILD
+)
+
+// kernelRequirement is the minimum kernel version supporting a flag
+type kernelRequirement struct {
+	flag uint64
+	name string
+	maj  int
+	min  int
+}
+
+var (
+	// fanotify_init flags
+	initFlagsKernelRequirements = []kernelRequirement{
+		{unix.FAN_ENABLE_AUDIT, "FAN_ENABLE_AUDIT", 4, 15},
+		{unix.FAN_REPORT_TID, "FAN_REPORT_TID", 4, 20},
+		{unix.FAN_REPORT_FID, "FAN_REPORT_FID", 5, 1},
+		{unix.FAN_REPORT_DIR_FID, "FAN_REPORT_DIR_FID", 5, 9},
+		{unix.FAN_REPORT_NAME, "FAN_REPORT_NAME", 5, 9},
+		{unix.FAN_REPORT_PIDFD, "FAN_REPORT_PIDFD", 5, 15},
+		{unix.FAN_REPORT_TARGET_FID, "FAN_REPORT_TARGET_FID", 5, 17},
+	}
+	// fanotify_mark event mask
+	markMaskKernelRequirements = []kernelRequirement{
+		{unix.FAN_OPEN_EXEC, "FAN_OPEN_EXEC", 5, 0},
+		{unix.FAN_OPEN_EXEC_PERM, "FAN_OPEN_EXEC_PERM", 5, 0},
+		{unix.FAN_ATTRIB, "FAN_ATTRIB", 5, 1},
+		{unix.FAN_CREATE, "FAN_CREATE", 5, 1},
+		{unix.FAN_DELETE, "FAN_DELETE", 5, 1},
+		{unix.FAN_DELETE_SELF, "FAN_DELETE_SELF", 5, 1},
+		{unix.FAN_MOVED_FROM, "FAN_MOVED_FROM", 5, 1},
+		{unix.FAN_MOVED_TO, "FAN_MOVED_TO", 5, 1},
+		{unix.FAN_MOVE_SELF, "FAN_MOVE_SELF", 5, 1},
+		{unix.FAN_FS_ERROR, "FAN_FS_ERROR", 5, 16},
+		{unix.FAN_RENAME, "FAN_RENAME", 5, 17},
+		{fanPreAccess, "FAN_PRE_ACCESS", 6, 14},
+	}
+	// fanotify_mark flags; inode and mount marks work on any kernel version
+	markTypeKernelRequirements = []kernelRequirement{
+		{unix.FAN_MARK_FILESYSTEM, "FAN_MARK_FILESYSTEM", 4, 20},
+		{fanMarkIgnore, "FAN_MARK_IGNORE", 6, 0},
+	}
+)
+
+// FeatureSet describes the fanotify flags and events supported by the running kernel.
+type FeatureSet struct {
+	// InitFlags holds the fanotify_init flags supported by the kernel
+	InitFlags uint
+	// MarkFlags holds the fanotify_mark flags supported by the kernel
+	MarkFlags uint
+	// Events holds the event types supported by the kernel
+	Events EventType
+	// ResponseInfo is true if permission responses can carry information records,
+	// such as the audit rule sent by [Listener.RespondWithAuditRule] (Linux 6.3)
+	ResponseInfo bool
+	// DenyErrno is true if permission events can be denied with a custom errno
+	// using [DenyWithErrno] (Linux 6.14)
+	DenyErrno bool
+	// Probed is true if the features were probed from the kernel. It is false when
+	// fanotify_init is not permitted, which is the case without CAP_SYS_ADMIN before
+	// Linux 5.13; the features are then derived from the kernel version.
+	Probed bool
+}
+
+var (
+	featuresMu sync.Mutex
+	// features is nil until the features were probed successfully
+	features *FeatureSet
+)
+
+// Features returns the fanotify features supported by the running kernel. The
+// features are probed by calling fanotify_init and fanotify_mark with each flag
+// on a scratch notification group, so features backported to older kernels are
+// detected. Listeners validate their flags and marks against this feature set.
+// The features are probed once; a probe that failed, for example because the
+// limit of notification groups was reached, is retried by the next call.
+func Features() (FeatureSet, error) {
+	featuresMu.Lock()
+	defer featuresMu.Unlock()
+	if features != nil {
+		return *features, nil
+	}
+	f, err := probeFeatures()
+	if err != nil {
+		return FeatureSet{}, err
+	}
+	features = &f
+	return f, nil
+}
+
+// HasInitFlags returns true if the kernel supports all of the fanotify_init flags.
+func (f FeatureSet) HasInitFlags(flags uint) bool {
+	return f.InitFlags&flags == flags
+}
+
+// HasMarkFlags returns true if the kernel supports all of the fanotify_mark flags.
+func (f FeatureSet) HasMarkFlags(flags uint) bool {
+	return f.MarkFlags&flags == flags
+}
+
+// HasEvents returns true if the kernel supports all of the event types.
+func (f FeatureSet) HasEvents(eventTypes EventType) bool {
+	return f.Events.Has(eventTypes)
+}
+
+// versionFeatures returns the features documented for the kernel version
+func versionFeatures(maj, min int) FeatureSet {
+	supported := func(requirements []kernelRequirement) uint64 {
+		var flags uint64
+		for _, r := range requirements {
+			if maj > r.maj || (maj == r.maj && min >= r.min) {
+				flags |= r.flag
+			}
+		}
+		return flags
+	}
+	return FeatureSet{
+		InitFlags:    baseInitFlags | uint(supported(initFlagsKernelRequirements)),
+		MarkFlags:    baseMarkFlags | uint(supported(markTypeKernelRequirements)),
+		Events:       EventType(baseEvents | supported(markMaskKernelRequirements)),
+		ResponseInfo: maj > 6 || (maj == 6 && min >= 3),
+		DenyErrno:    maj > 6 || (maj == 6 && min >= 14),
+	}
+}
+
+// probePreContent probes the features of pre-content groups: the pre-content
+// events, which are invalid on other groups, and the permission responses, by
+// writing responses for no event (FAN_NOFD) with an audit rule record; the kernel
+// validates the response and the record and returns without looking up an event.
+// Pre-content groups require CAP_SYS_ADMIN; without it the features are derived
+// from the kernel version.
+func probePreContent(f *FeatureSet) error {
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_PRE_CONTENT|unix.FAN_CLOEXEC, unix.O_RDONLY)
+	if err == unix.EPERM {
+		maj, min, err := kernelVersion()
+		if err != nil {
+			return err
+		}
+		versioned := versionFeatures(maj, min)
+		f.Events |= versioned.Events & fanPreAccess
+		f.ResponseInfo = versioned.ResponseInfo
+		f.DenyErrno = versioned.DenyErrno
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fanotify_init: %w", err)
+	}
+	defer unix.Close(fd)
+	// filesystems without pre-content support fail with EOPNOTSUPP once the event
+	// was accepted
+	if probeSupported(unix.FanotifyMark(fd, unix.FAN_MARK_ADD, fanPreAccess, unix.AT_FDCWD, "/")) {
+		f.Events |= fanPreAccess
+	}
+	info := auditRuleInfo(AuditRule{})
+	f.ResponseInfo = writeResponse(fd, unix.FAN_NOFD, Allow, info) == nil
+	f.DenyErrno = f.ResponseInfo && writeResponse(fd, unix.FAN_NOFD, DenyWithErrno(unix.EIO), info) == nil
+	return nil
+}
+
+// probeSupported interprets the result of a probe. The kernel validates the flags
+// before any other argument, so only EINVAL means the flag is unknown; other errors,
+// such as EPERM without CAP_SYS_ADMIN, are raised once the flag was accepted.
+func probeSupported(err error) bool {
+	return err != unix.EINVAL
+}
+
+func probeFeatures() (FeatureSet, error) {
+	probeFlags := uint(unix.FAN_CLASS_NOTIF | unix.FAN_CLOEXEC)
+	fd, err := unix.FanotifyInit(probeFlags, unix.O_RDONLY)
+	if err == unix.EPERM {
+		// without CAP_SYS_ADMIN the groups must report file identifiers (Linux 5.13)
+		probeFlags |= unix.FAN_REPORT_FID
+		fd, err = unix.FanotifyInit(probeFlags, unix.O_RDONLY)
+	}
+	if err == unix.EPERM {
+		maj, min, err := kernelVersion()
+		if err != nil {
+			return FeatureSet{}, err
+		}
+		return versionFeatures(maj, min), nil
+	}
+	if err != nil {
+		return FeatureSet{}, fmt.Errorf("fanotify_init: %w", err)
+	}
+	defer unix.Close(fd)
+
+	f := FeatureSet{
+		InitFlags: baseInitFlags,
+		MarkFlags: baseMarkFlags,
+		Events:    baseEvents,
+		Probed:    true,
+	}
+	for _, r := range initFlagsKernelRequirements {
+		flags := probeFlags | uint(r.flag)
+		switch r.flag {
+		case unix.FAN_REPORT_NAME:
+			// FAN_REPORT_NAME is only valid with FAN_REPORT_DIR_FID
+			flags |= unix.FAN_REPORT_DIR_FID
+		case unix.FAN_REPORT_TARGET_FID:
+			// FAN_REPORT_TARGET_FID is only valid with FAN_REPORT_FID and FAN_REPORT_DFID_NAME
+			flags |= unix.FAN_REPORT_FID | unix.FAN_REPORT_DFID_NAME
+		}
+		probeFd, err := unix.FanotifyInit(flags, unix.O_RDONLY)
+		if err == nil {
+			unix.Close(probeFd)
+		} else if err != unix.EINVAL && err != unix.EPERM {
+			return FeatureSet{}, fmt.Errorf("fanotify_init: %s: %w", r.name, err)
+		}
+		if probeSupported(err) {
+			f.InitFlags |= uint(r.flag)
+		}
+	}
+	for _, r := range markTypeKernelRequirements {
+		err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|uint(r.flag), unix.FAN_MODIFY, unix.AT_FDCWD, "/")
+		if probeSupported(err) {
+			f.MarkFlags |= uint(r.flag)
+		}
+	}
+
+	// directory events need a group reporting file identifiers and FAN_RENAME needs names
+	flags := probeFlags
+	if f.HasInitFlags(unix.FAN_REPORT_FID | unix.FAN_REPORT_DFID_NAME) {
+		flags |= unix.FAN_REPORT_FID | unix.FAN_REPORT_DFID_NAME
+	} else if f.HasInitFlags(unix.FAN_REPORT_FID) {
+		flags |= unix.FAN_REPORT_FID
+	}
+	eventsFd, err := unix.FanotifyInit(flags, unix.O_RDONLY)
+	if err != nil {
+		return FeatureSet{}, fmt.Errorf("fanotify_init: %w", err)
+	}
+	defer unix.Close(eventsFd)
+	for _, r := range markMaskKernelRequirements {
+		if r.flag == unix.FAN_OPEN_EXEC_PERM || r.flag == fanPreAccess {
+			// permission events are invalid on notification groups; FAN_OPEN_EXEC_PERM
+			// was added along with FAN_OPEN_EXEC and FAN_PRE_ACCESS is probed on a
+			// pre-content group
+			continue
+		}
+		markFlags := uint(unix.FAN_MARK_ADD)
+		if r.flag == unix.FAN_FS_ERROR {
+			markFlags |= unix.FAN_MARK_FILESYSTEM
+		}
+		err := unix.FanotifyMark(eventsFd, markFlags, r.flag, unix.AT_FDCWD, "/")
+		if probeSupported(err) {
+			f.Events |= EventType(r.flag)
+		}
+	}
+	if f.HasEvents(unix.FAN_OPEN_EXEC) {
+		f.Events |= unix.FAN_OPEN_EXEC_PERM
+	}
+	if err := probePreContent(&f); err != nil {
+		return FeatureSet{}, err
+	}
+	return f, nil
+}
+
+// kernelVersion returns the major and minor version of the running kernel
+func kernelVersion() (maj, min int, err error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return 0, 0, err
+	}
+	return parseKernelRelease(unix.ByteSliceToString(uts.Release[:]))
+}
+
+// parseKernelRelease parses the major and minor version of a kernel release such as
+// "5.14.0-362.el9.x86_64". A missing minor version is reported as 0.
+func parseKernelRelease(release string) (maj, min int, err error) {
+	n, _ := fmt.Sscanf(release, "%d.%d", &maj, &min)
+	if n == 0 {
+		return 0, 0, fmt.Errorf("invalid kernel release %q", release)
+	}
+	return maj, min, nil
+}
+
+// checkFeatures returns ErrUnsupportedOnKernelVersion naming the first flag set in
+// flags that is missing from the supported flags.
+func checkFeatures(requirements []kernelRequirement, flags, supported uint64) error {
+	for _, r := range requirements {
+		if flags&r.flag != r.flag || supported&r.flag == r.flag {
+			continue
+		}
+		return fmt.Errorf("%w: %s is not supported by the running kernel (requires Linux kernel %d.%d or later)", ErrUnsupportedOnKernelVersion, r.name, r.maj, r.min)
+	}
+	return nil
+}
+
+// Check if specified fanotify_init flags are supported by the kernel.
+// If none of the defined flags are specified then the basic option works
+// on any kernel version.
+func fanotifyInitFlagsKernelSupport(flags uint, f FeatureSet) error {
+	return checkFeatures(initFlagsKernelRequirements, uint64(flags), uint64(f.InitFlags))
+}
+
+// Check if specified fanotify_mark flags are supported by the kernel.
+// If none of the defined flags are specified then the basic option works
+// on any kernel version.
+func fanotifyMarkFlagsKernelSupport(mask uint64, f FeatureSet) error {
+	return checkFeatures(markMaskKernelRequirements, mask, uint64(f.Events))
+}
+
+// Check if specified fanotify_mark mark type is supported by the kernel.
+// Inode and mount marks work on any kernel version.
+func fanotifyMarkTypeKernelSupport(flags uint, f FeatureSet) error {
+	return checkFeatures(markTypeKernelRequirements, uint64(flags), uint64(f.MarkFlags))
+}
@@ -0,0 +1,244 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// fanotify_init flags that may be passed using WithReportFlags
+	reportFlagsMask = unix.FAN_REPORT_TID |
+		unix.FAN_REPORT_FID |
+		unix.FAN_REPORT_DIR_FID |
+		unix.FAN_REPORT_NAME |
+		unix.FAN_REPORT_TARGET_FID |
+		unix.FAN_REPORT_PIDFD
+
+	defaultEventBufferSize = 4096
+	defaultErrorBufferSize = 64
+)
+
+// Option configures a listener created with [NewListenerWithOptions].
+type Option func(*options)
+
+type options struct {
+	entireMount          bool
+	permType             PermissionType
+	reportFlags          uint
+	reportFlagsSet       bool
+	extraReportFlags     uint
+	readWrite            bool
+	noAtime              bool
+	closeOnExec          bool
+	unlimitedQueue       bool
+	unlimitedMarks       bool
+	eventBufferSize      int
+	permissionBufferSize int
+	errorBufferSize      int
+	unprivileged         bool
+	enableAudit          bool
+	permissionTimeout    time.Duration
+	timeoutDecision      Decision
+	decisionReporter     func(PermissionDecision)
+	allowCache           bool
+	autoClose            bool
+}
+
+func defaultOptions() options {
+	return options{
+		permType:             PermissionNone,
+		closeOnExec:          true,
+		eventBufferSize:      defaultEventBufferSize,
+		permissionBufferSize: defaultEventBufferSize,
+		errorBufferSize:      defaultErrorBufferSize,
+	}
+}
+
+// WithEntireMount initializes the listener to monitor the entire mount point
+// (when true) or allows adding files or directories to the listener's watch
+// list (when false). The default is false.
+func WithEntireMount(entireMount bool) Option {
+	return func(o *options) {
+		o.entireMount = entireMount
+	}
+}
+
+// WithPermissionType selects the notification class of the listener.
+// [PermissionNone] (the default) creates a listener for notification events only,
+// [PreContent] and [PostContent] create a listener for both notification and
+// permission events.
+func WithPermissionType(permType PermissionType) Option {
+	return func(o *options) {
+		o.permType = permType
+	}
+}
+
+// WithReportFlags sets the FAN_REPORT_* flags passed to fanotify_init, for example
+// unix.FAN_REPORT_FID or unix.FAN_REPORT_DFID_NAME. Passing 0 disables the reporting
+// of file identifiers. When the option is not used the flags are chosen based on the
+// kernel version, as described in [NewListener].
+// Flags other than FAN_REPORT_* result in [ErrInvalidFlagCombination].
+func WithReportFlags(flags uint) Option {
+	return func(o *options) {
+		o.reportFlags = flags
+		o.reportFlagsSet = true
+	}
+}
+
+// WithReportPidfd reports a pidfd for the process that caused each event in
+// [Event].Process. The pidfd guards against the process ID being reused before
+// the event is handled. Requires Linux kernel 5.15 or later.
+func WithReportPidfd() Option {
+	return func(o *options) {
+		o.extraReportFlags |= unix.FAN_REPORT_PIDFD
+	}
+}
+
+// WithReportTid reports the thread ID instead of the process ID of the thread that
+// caused each event. The thread ID is available in [Event].Tid. Cannot be combined
+// with [WithReportPidfd]. Requires Linux kernel 4.20 or later.
+func WithReportTid() Option {
+	return func(o *options) {
+		o.extraReportFlags |= unix.FAN_REPORT_TID
+	}
+}
+
+// WithUnprivileged creates the listener in unprivileged mode, which does not require
+// CAP_SYS_ADMIN and requires Linux kernel 5.13 or later. Unprivileged listeners
+// report file identifiers and only permit marks on files and directories added with
+// [Listener.AddWatch]; mount and filesystem marks, permission events, unlimited
+// queues and marks, thread IDs and pidfds return an error wrapping [ErrCapSysAdmin].
+//
+// Events of unprivileged listeners carry no file descriptor (Fd is unix.FAN_NOFD)
+// and their paths are the paths used to add the watches. The Pid of events caused
+// by other processes is 0.
+func WithUnprivileged() Option {
+	return func(o *options) {
+		o.unprivileged = true
+	}
+}
+
+// WithEnableAudit allows the responses to permission events to be logged to the
+// audit subsystem with [Decision.WithAudit]. Requires CAP_AUDIT_WRITE and Linux
+// kernel 4.15 or later.
+func WithEnableAudit() Option {
+	return func(o *options) {
+		o.enableAudit = true
+	}
+}
+
+// WithPermissionTimeout sets the deadline to respond to permission events. Events
+// not answered within timeout after they were read, including the time spent waiting
+// in the PermissionEvents channel, are answered with decision. Their file descriptors
+// stay open until the event is passed to [Listener.Respond] or [Event.Close], as the
+// consumer may still be reading the file. Each timeout is reported on the Errors
+// channel as [ErrPermissionTimeout] and counted by [Listener.PermissionTimeouts]. A
+// timeout of 0 (the default) waits for the response indefinitely.
+func WithPermissionTimeout(timeout time.Duration, decision Decision) Option {
+	return func(o *options) {
+		o.permissionTimeout = timeout
+		o.timeoutDecision = decision
+	}
+}
+
+// WithDecisionReporter calls report with each response sent to a permission event
+// by [Listener.Allow], [Listener.Deny], [Listener.Respond] or
+// [Listener.HandlePermissions], including the time taken to decide. report is called
+// by the goroutine that responded and must not block. The default decisions sent by
+// [WithPermissionTimeout] are counted by [Listener.PermissionTimeouts] instead.
+func WithDecisionReporter(report func(PermissionDecision)) Option {
+	return func(o *options) {
+		o.decisionReporter = report
+	}
+}
+
+// WithAllowCache caches the Allow decisions sent to permission events in the kernel:
+// once a file is allowed, the same event type is ignored for the file until it is
+// modified or the cache is flushed with [Listener.FlushAllowCache]. Decisions with
+// [Decision.WithAudit] are not cached. The cache applies to every process accessing
+// the file, so it must not be used when decisions depend on the process. Writes
+// through shared memory mappings do not invalidate the cache.
+func WithAllowCache() Option {
+	return func(o *options) {
+		o.allowCache = true
+	}
+}
+
+// WithAutoClose closes the file descriptor and the pidfd of each event once the
+// handler passed to [Listener.HandleEvents] or [Listener.HandlePermissions] returns,
+// so handlers cannot leak them. Handlers must not retain the descriptors; use
+// [Event.File] within the handler to read the file.
+func WithAutoClose() Option {
+	return func(o *options) {
+		o.autoClose = true
+	}
+}
+
+// WithReadWrite opens the file descriptors of the events for reading and writing
+// instead of reading only.
+func WithReadWrite() Option {
+	return func(o *options) {
+		o.readWrite = true
+	}
+}
+
+// WithNoAtime opens the file descriptors of the events with O_NOATIME, so the
+// listener reading the file does not update its last access time.
+func WithNoAtime() Option {
+	return func(o *options) {
+		o.noAtime = true
+	}
+}
+
+// WithCloseOnExec sets the close-on-exec flag on the notification group and on the
+// file descriptors of the events. The default is true.
+func WithCloseOnExec(closeOnExec bool) Option {
+	return func(o *options) {
+		o.closeOnExec = closeOnExec
+	}
+}
+
+// WithUnlimitedQueue removes the limit on the number of events queued in the kernel
+// for the listener (16384 by default, see /proc/sys/fs/fanotify/max_queued_events).
+// Events are lost with a [QueueOverflow] event when the limit is exceeded.
+// Requires CAP_SYS_ADMIN.
+func WithUnlimitedQueue() Option {
+	return func(o *options) {
+		o.unlimitedQueue = true
+	}
+}
+
+// WithUnlimitedMarks removes the limit on the number of marks of the listener
+// (8192 by default, see /proc/sys/fs/fanotify/max_user_marks). Adding a mark past the
+// limit results in [ErrMarkLimit]. Requires CAP_SYS_ADMIN.
+func WithUnlimitedMarks() Option {
+	return func(o *options) {
+		o.unlimitedMarks = true
+	}
+}
+
+// WithEventBufferSize sets the buffer size of the Events channel. The default is 4096.
+func WithEventBufferSize(n int) Option {
+	return func(o *options) {
+		o.eventBufferSize = n
+	}
+}
+
+// WithPermissionEventBufferSize sets the buffer size of the PermissionEvents channel.
+// The default is 4096.
+func WithPermissionEventBufferSize(n int) Option {
+	return func(o *options) {
+		o.permissionBufferSize = n
+	}
+}
+
+// WithErrorBufferSize sets the buffer size of the Errors channel. The default is 64.
+func WithErrorBufferSize(n int) Option {
+	return func(o *options) {
+		o.errorBufferSize = n
+	}
+}
@@ -0,0 +1,173 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// PermissionDecision describes a response sent to a permission event.
+type PermissionDecision struct {
+	// Event is the permission event. Its file descriptor may already be closed.
+	Event Event
+	// Decision is the response sent for the event
+	Decision Decision
+	// Latency is the time between the reading of the event and the response,
+	// including the time spent waiting in the PermissionEvents channel
+	Latency time.Duration
+}
+
+// pendingPermission is a permission event waiting for a response before the
+// deadline set with WithPermissionTimeout.
+type pendingPermission struct {
+	// seq identifies the event; the file descriptor may be reused by a later event
+	// once the event timed out and its file descriptor was closed
+	seq   uint64
+	timer *time.Timer
+}
+
+// PermissionTimeouts returns the number of permission events answered with the
+// default decision of [WithPermissionTimeout] because no response was sent in time.
+func (l *Listener) PermissionTimeouts() uint64 {
+	if l == nil {
+		panic("nil listener")
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.permissionTimeouts
+}
+
+// trackPermission starts the deadline of the permission event. The event is
+// answered with the default decision unless it is claimed before the deadline.
+func (l *Listener) trackPermission(event *Event) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	event.seq = l.seq
+	event.received = time.Now()
+	if l.allowCache != nil && event.Fd >= 0 {
+		if version, err := statVersion(event.Fd); err == nil {
+			event.version = version
+		}
+	}
+	if l.permissionTimeout == 0 {
+		return
+	}
+	fd, seq := event.Fd, event.seq
+	l.pending[fd] = &pendingPermission{
+		seq: seq,
+		timer: time.AfterFunc(l.permissionTimeout, func() {
+			l.permissionTimedOut(fd, seq)
+		}),
+	}
+}
+
+// claimPermission stops the deadline of the event and reports whether the caller
+// owns the response and the file descriptor of the event. It returns an error
+// wrapping ErrPermissionTimeout if the event was already answered after its
+// deadline.
+func (l *Listener) claimPermission(event Event) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.permissionTimeout == 0 || !isPermissionEvent(event.EventTypes) {
+		return nil
+	}
+	p, found := l.pending[event.Fd]
+	if !found || p.seq != event.seq {
+		return fmt.Errorf("%w: the default decision was sent after %v", ErrPermissionTimeout, l.permissionTimeout)
+	}
+	p.timer.Stop()
+	delete(l.pending, event.Fd)
+	return nil
+}
+
+// permissionTimedOut answers the event with the default decision if it is still
+// pending. The response is written with l.mu held so that Stop cannot close the
+// notification group in the meantime. The file descriptor is left open as the
+// consumer of the event may still be using it; it is closed by Respond or Close.
+func (l *Listener) permissionTimedOut(fd int, seq uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	p, found := l.pending[fd]
+	if l.stopped || !found || p.seq != seq {
+		return
+	}
+	delete(l.pending, fd)
+	l.permissionTimeouts++
+	if err := writeResponse(l.fd, fd, l.timeoutDecision, nil); err != nil {
+		l.reportError(fmt.Errorf("%w: %v", ErrPermissionTimeout, err))
+		return
+	}
+	l.reportError(fmt.Errorf("%w: the default decision was sent after %v", ErrPermissionTimeout, l.permissionTimeout))
+}
+
+// stopPermissionTimers stops the deadlines of the pending events. It must be
+// called with l.mu held.
+func (l *Listener) stopPermissionTimers() {
+	for fd, p := range l.pending {
+		p.timer.Stop()
+		delete(l.pending, fd)
+	}
+}
+
+// reportDecision passes the response sent to the event to the reporter set with
+// WithDecisionReporter
+func (l *Listener) reportDecision(e Event, d Decision) {
+	if l.decisionReporter == nil {
+		return
+	}
+	l.decisionReporter(PermissionDecision{Event: e, Decision: d, Latency: time.Since(e.received)})
+}
+
+// HandlePermissions answers the permission events of the listener with the decisions
+// of fn until the listener is stopped. fn is called concurrently by the specified
+// number of goroutines, so that a slow decision does not delay the other events; at
+// most workers events are being decided at a time and the following events wait in
+// the PermissionEvents channel. Each decision is sent for the event it was made for
+// and the file descriptor of the event is closed afterwards, so fn must not close it.
+// The pidfd of [Event.Process], reported with [WithReportPidfd], is also closed
+// afterwards for listeners created with [WithAutoClose]; otherwise fn owns it and
+// must close it with [Process.Close], including for the events it does not inspect.
+//
+// Decisions rejected by [Listener.Respond] are reported on the Errors channel and
+// replaced with Deny. The latency of each decision is reported to the function set
+// with [WithDecisionReporter]. HandlePermissions must be the only consumer of the
+// PermissionEvents channel. [os.ErrInvalid] is returned if workers is less than 1.
+func (l *Listener) HandlePermissions(workers int, fn func(Event) Decision) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if workers < 1 || fn == nil {
+		return os.ErrInvalid
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range l.PermissionEvents {
+				l.handlePermission(e, fn)
+			}
+		}()
+	}
+	wg.Wait()
+	return nil
+}
+
+func (l *Listener) handlePermission(e Event, fn func(Event) Decision) {
+	d := fn(e)
+	if err := checkDecision(l.flags, l.features, d); err != nil {
+		l.reportAsyncError(fmt.Errorf("decision for %s: %w", eventPath(e), err))
+		d = Deny
+	}
+	if err := l.Respond(e, d); err != nil {
+		l.reportAsyncError(fmt.Errorf("respond: %s: %w", eventPath(e), err))
+	}
+	if l.autoClose {
+		e.Process.Close()
+	}
+}
@@ -0,0 +1,460 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrInvalidPolicy indicates a policy or one of its rules cannot be used
+var ErrInvalidPolicy = errors.New("invalid policy")
+
+// Rule matches permission events and decides them. A rule matches an event when
+// all of its conditions match; conditions left empty match every event.
+type Rule struct {
+	// Name identifies the rule
+	Name string
+	// Path is a glob pattern matched against the path of the file. The pattern uses
+	// the syntax of [filepath.Match]; in addition "**" matches any number of
+	// directories, for example "/home/**/*.sh".
+	Path string
+	// EventTypes matches events of any of the permission event types, for example
+	// [FileOpenToExecutePermission]
+	EventTypes EventType
+	// Exe is a glob pattern matched against the executable of the process
+	// requesting the access
+	Exe string
+	// UIDs matches processes with any of the real user IDs
+	UIDs []int
+	// SHA256 matches files whose content has any of the hex encoded SHA-256 digests
+	SHA256 []string
+	// Decision is the decision for the events matching the rule
+	Decision Decision
+}
+
+type compiledRule struct {
+	Rule
+	path *regexp.Regexp
+	exe  *regexp.Regexp
+}
+
+// Policy decides permission events with an ordered list of rules. The decision
+// of the first rule matching an event applies; events matching no rule receive the
+// default decision.
+type Policy struct {
+	rules           []compiledRule
+	defaultDecision Decision
+}
+
+// NewPolicy returns a policy evaluating the rules in order. An error wrapping
+// [ErrInvalidPolicy] is returned if a pattern of the rules is malformed or a decision
+// is neither [Allow] nor [Deny].
+func NewPolicy(defaultDecision Decision, rules ...Rule) (*Policy, error) {
+	if err := decisionValid(defaultDecision); err != nil {
+		return nil, fmt.Errorf("%w: default: %v", ErrInvalidPolicy, err)
+	}
+	p := &Policy{defaultDecision: defaultDecision}
+	for i, rule := range rules {
+		if err := decisionValid(rule.Decision); err != nil {
+			return nil, fmt.Errorf("%w: rule %d (%s): %v", ErrInvalidPolicy, i, rule.Name, err)
+		}
+		compiled := compiledRule{Rule: rule}
+		compiled.UIDs = append([]int(nil), rule.UIDs...)
+		compiled.SHA256 = append([]string(nil), rule.SHA256...)
+		var err error
+		if rule.Path != "" {
+			if compiled.path, err = compileGlob(rule.Path); err != nil {
+				return nil, fmt.Errorf("%w: rule %d (%s): path: %v", ErrInvalidPolicy, i, rule.Name, err)
+			}
+		}
+		if rule.Exe != "" {
+			if compiled.exe, err = compileGlob(rule.Exe); err != nil {
+				return nil, fmt.Errorf("%w: rule %d (%s): exe: %v", ErrInvalidPolicy, i, rule.Name, err)
+			}
+		}
+		for j, digest := range rule.SHA256 {
+			if b, err := hex.DecodeString(digest); err != nil || len(b) != sha256.Size {
+				return nil, fmt.Errorf("%w: rule %d (%s): malformed sha256 %q", ErrInvalidPolicy, i, rule.Name, digest)
+			}
+			compiled.SHA256[j] = strings.ToLower(digest)
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+// policyFile is the JSON representation of a policy
+type policyFile struct {
+	Default string `json:"default"`
+	Rules   []struct {
+		Name       string   `json:"name"`
+		Path       string   `json:"path"`
+		EventTypes []string `json:"eventTypes"`
+		Exe        string   `json:"exe"`
+		UIDs       []int    `json:"uids"`
+		SHA256     []string `json:"sha256"`
+		Decision   string   `json:"decision"`
+		Errno      string   `json:"errno"`
+		Audit      bool     `json:"audit"`
+	} `json:"rules"`
+}
+
+// LoadPolicy reads a policy in JSON format, for example:
+//
+//	{
+//	  "default": "allow",
+//	  "rules": [
+//	    {"name": "no-exec-from-tmp", "path": "/tmp/**", "eventTypes": ["FileOpenToExecutePermission"], "decision": "deny"},
+//	    {"name": "secrets", "path": "/etc/secrets/*", "uids": [0], "decision": "allow"},
+//	    {"name": "secrets-others", "path": "/etc/secrets/*", "decision": "deny", "errno": "EIO", "audit": true}
+//	  ]
+//	}
+//
+// Decisions are "allow" or "deny". A denial may return an errno other than EPERM
+// (see [DenyWithErrno]) and a decision may be logged to the audit subsystem (see
+// [Decision.WithAudit]). Event types are the names of the permission event types:
+// "FileOpenPermission", "FileOpenToExecutePermission" and "FileAccessPermission".
+func LoadPolicy(r io.Reader) (*Policy, error) {
+	var f policyFile
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidPolicy, err)
+	}
+	defaultDecision, err := parseDecision(f.Default, "", false)
+	if err != nil {
+		return nil, fmt.Errorf("%w: default: %v", ErrInvalidPolicy, err)
+	}
+	var rules []Rule
+	for i, r := range f.Rules {
+		rule := Rule{Name: r.Name, Path: r.Path, Exe: r.Exe, UIDs: r.UIDs, SHA256: r.SHA256}
+		for _, name := range r.EventTypes {
+			et, found := permissionEventTypes[name]
+			if !found {
+				return nil, fmt.Errorf("%w: rule %d (%s): unknown event type %q", ErrInvalidPolicy, i, r.Name, name)
+			}
+			rule.EventTypes |= et
+		}
+		if rule.Decision, err = parseDecision(r.Decision, r.Errno, r.Audit); err != nil {
+			return nil, fmt.Errorf("%w: rule %d (%s): %v", ErrInvalidPolicy, i, r.Name, err)
+		}
+		rules = append(rules, rule)
+	}
+	return NewPolicy(defaultDecision, rules...)
+}
+
+// LoadPolicyFile reads a policy in JSON format from the file. See [LoadPolicy].
+func LoadPolicyFile(name string) (*Policy, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadPolicy(f)
+}
+
+// errnos that may be returned by a denial; see DenyWithErrno
+var denyErrnos = map[string]unix.Errno{
+	"EPERM":   unix.EPERM,
+	"EIO":     unix.EIO,
+	"EBUSY":   unix.EBUSY,
+	"ETXTBSY": unix.ETXTBSY,
+	"EAGAIN":  unix.EAGAIN,
+	"ENOSPC":  unix.ENOSPC,
+	"EDQUOT":  unix.EDQUOT,
+}
+
+var permissionEventTypes = map[string]EventType{
+	"FileOpenPermission":          FileOpenPermission,
+	"FileOpenToExecutePermission": FileOpenToExecutePermission,
+	"FileAccessPermission":        FileAccessPermission,
+}
+
+func parseDecision(decision, errno string, audit bool) (Decision, error) {
+	var d Decision
+
+	switch decision {
+	case "allow":
+		d = Allow
+	case "deny":
+		d = Deny
+	default:
+		return 0, fmt.Errorf("unknown decision %q", decision)
+	}
+	if errno != "" {
+		e, found := denyErrnos[errno]
+		if !found || d != Deny {
+			return 0, fmt.Errorf("errno %q cannot be returned", errno)
+		}
+		d = DenyWithErrno(e)
+	}
+	if audit {
+		d = d.WithAudit()
+	}
+	return d, nil
+}
+
+// compileGlob converts the glob pattern to a regular expression matching the
+// whole name.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					// "**/" matches zero or more directories
+					i++
+					expr.WriteString("(?:.*/)?")
+				} else {
+					expr.WriteString(".*")
+				}
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end <= 0 {
+				return nil, filepath.ErrBadPattern
+			}
+			// character classes share the syntax of regular expressions
+			expr.WriteString(pattern[i : i+end+2])
+			i += end + 1
+		case '\\':
+			i++
+			if i == len(pattern) {
+				return nil, filepath.ErrBadPattern
+			}
+			expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// Default returns the decision for events matching no rule.
+func (p *Policy) Default() Decision {
+	return p.defaultDecision
+}
+
+// Evaluate returns the decision for the permission event and the rule that
+// matched it, or the default decision and a nil rule if no rule matched.
+// The process and the content of the file are only inspected if a rule requires it.
+// If a condition cannot be evaluated, for example because the process exited,
+// the default decision is returned along with the error.
+func (p *Policy) Evaluate(e Event) (Decision, *Rule, error) {
+	subject := &policySubject{event: e}
+	for i := range p.rules {
+		rule := &p.rules[i]
+		matched, err := rule.match(subject)
+		if err != nil {
+			return p.defaultDecision, nil, fmt.Errorf("rule %d (%s): %w", i, rule.Name, err)
+		}
+		if matched {
+			matchedRule := rule.Rule
+			return rule.Decision, &matchedRule, nil
+		}
+	}
+	return p.defaultDecision, nil, nil
+}
+
+func (r *compiledRule) match(s *policySubject) (bool, error) {
+	if r.EventTypes != 0 && s.event.EventTypes&r.EventTypes == 0 {
+		return false, nil
+	}
+	if r.path != nil && !r.path.MatchString(eventPath(s.event)) {
+		return false, nil
+	}
+	if r.exe != nil {
+		exe, err := s.exe()
+		if err != nil {
+			return false, err
+		}
+		if !r.exe.MatchString(exe) {
+			return false, nil
+		}
+	}
+	if len(r.UIDs) > 0 {
+		uid, err := s.uid()
+		if err != nil {
+			return false, err
+		}
+		if !containsInt(r.UIDs, uid) {
+			return false, nil
+		}
+	}
+	if len(r.SHA256) > 0 {
+		digest, err := s.sha256()
+		if err != nil {
+			return false, err
+		}
+		if !containsString(r.SHA256, digest) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// policySubject looks up the process and the file of an event once for all rules
+type policySubject struct {
+	event    Event
+	exePath  *string
+	uidValue *int
+	digest   *string
+}
+
+func (s *policySubject) exe() (string, error) {
+	if s.exePath == nil {
+		var exe string
+		var err error
+		if s.event.Process != nil {
+			exe, err = s.event.Process.Exe()
+		} else {
+			exe, err = os.Readlink(fmt.Sprintf("/proc/%d/exe", s.event.Pid))
+		}
+		if err != nil {
+			return "", fmt.Errorf("exe of pid %d: %w", s.event.Pid, err)
+		}
+		s.exePath = &exe
+	}
+	return *s.exePath, nil
+}
+
+func (s *policySubject) uid() (int, error) {
+	if s.uidValue == nil {
+		var uid int
+		var err error
+		if s.event.Process != nil {
+			uid, err = s.event.Process.UID()
+		} else {
+			var data []byte
+			data, err = os.ReadFile(fmt.Sprintf("/proc/%d/status", s.event.Pid))
+			if err == nil {
+				uid, err = parseStatusUID(s.event.Pid, data)
+			}
+		}
+		if err != nil {
+			return -1, fmt.Errorf("uid of pid %d: %w", s.event.Pid, err)
+		}
+		s.uidValue = &uid
+	}
+	return *s.uidValue, nil
+}
+
+func (s *policySubject) sha256() (string, error) {
+	if s.digest == nil {
+		digest, err := fileSHA256(s.event.Fd)
+		if err != nil {
+			return "", fmt.Errorf("sha256 of %s: %w", eventPath(s.event), err)
+		}
+		s.digest = &digest
+	}
+	return *s.digest, nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 digest of the content of the file.
+// The file is read with pread, so the file offset of fd is not changed.
+func fileSHA256(fd int) (string, error) {
+	if fd < 0 {
+		return "", fmt.Errorf("%w: event has no file descriptor", os.ErrInvalid)
+	}
+	dup, err := unix.FcntlInt(uintptr(fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return "", err
+	}
+	f := os.NewFile(uintptr(dup), "")
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, math.MaxInt64)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// eventPath returns the path of the file of the event
+func eventPath(e Event) string {
+	if e.FileName == "" {
+		return e.Path
+	}
+	return filepath.Join(e.Path, e.FileName)
+}
+
+func containsInt(values []int, v int) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// EnforcePolicy answers the permission events of the listener with the decisions of
+// the policy until the listener is stopped or ctx is done. Errors evaluating the
+// policy or responding to events are reported on the Errors channel; the events are
+// then answered with the default decision of the policy. Decisions the listener cannot
+// send, such as a denial with an errno on a PostContent listener, are reported and
+// replaced with the default decision, or with Deny if the listener cannot send the
+// default decision either. The file descriptor and the pidfd of each event are
+// closed once it is answered. EnforcePolicy must be the only consumer of the
+// PermissionEvents channel.
+func (l *Listener) EnforcePolicy(ctx context.Context, p *Policy) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-l.PermissionEvents:
+			if !ok {
+				return nil
+			}
+			d, _, err := p.Evaluate(e)
+			if err != nil {
+				l.reportAsyncError(fmt.Errorf("policy: %s: %w", eventPath(e), err))
+			}
+			if err := checkDecision(l.flags, l.features, d); err != nil {
+				l.reportAsyncError(fmt.Errorf("decision for %s: %w", eventPath(e), err))
+				d = p.defaultDecision
+				if checkDecision(l.flags, l.features, d) != nil {
+					d = Deny
+				}
+			}
+			if err := l.Respond(e, d); err != nil {
+				l.reportAsyncError(fmt.Errorf("respond: %s: %w", eventPath(e), err))
+			}
+			e.Process.Close()
+		}
+	}
+}
@@ -0,0 +1,151 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// ErrProcessExited indicates the process that caused the event has exited
+// and its details are no longer available.
+var ErrProcessExited = errors.New("process exited")
+
+// Process refers to the process that caused an event through a pidfd.
+// Unlike the bare process ID, the pidfd cannot be reused by another process, so
+// the details read through the Process methods are guaranteed to belong to the
+// process that caused the event. Process is only available for listeners created
+// with [WithReportPidfd].
+type Process struct {
+	// Pid is the process ID of the process
+	Pid int
+	// Pidfd is the pidfd of the process. The value is unix.FAN_NOPIDFD if the
+	// process exited before the event was read and unix.FAN_EPIDFD if the pidfd
+	// could not be created.
+	Pidfd int
+}
+
+// Comm returns the command name of the process.
+func (p *Process) Comm() (string, error) {
+	data, err := p.readFile("comm")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+// Exe returns the path of the executable of the process.
+func (p *Process) Exe() (string, error) {
+	var name [unix.PathMax]byte
+
+	dirfd, err := p.procDir()
+	if err != nil {
+		return "", err
+	}
+	defer unix.Close(dirfd)
+	n, err := unix.Readlinkat(dirfd, "exe", name[:])
+	if err != nil {
+		return "", p.procError(err)
+	}
+	return string(name[:n]), nil
+}
+
+// Cmdline returns the command line arguments of the process.
+func (p *Process) Cmdline() ([]string, error) {
+	data, err := p.readFile("cmdline")
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSuffix(data, []byte{0})
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return strings.Split(string(data), "\x00"), nil
+}
+
+// UID returns the real user ID of the process.
+func (p *Process) UID() (int, error) {
+	data, err := p.readFile("status")
+	if err != nil {
+		return -1, err
+	}
+	return parseStatusUID(p.Pid, data)
+}
+
+// parseStatusUID returns the real user ID from the /proc/<pid>/status file
+func parseStatusUID(pid int, data []byte) (int, error) {
+	for _, line := range strings.Split(string(data), "\n") {
+		if !strings.HasPrefix(line, "Uid:") {
+			continue
+		}
+		fields := strings.Fields(strings.TrimPrefix(line, "Uid:"))
+		if len(fields) == 0 {
+			break
+		}
+		return strconv.Atoi(fields[0])
+	}
+	return -1, fmt.Errorf("uid not found in /proc/%d/status", pid)
+}
+
+// Close closes the pidfd of the process.
+func (p *Process) Close() error {
+	if p == nil || p.Pidfd < 0 {
+		return nil
+	}
+	err := unix.Close(p.Pidfd)
+	p.Pidfd = unix.FAN_NOPIDFD
+	return err
+}
+
+// procDir opens the /proc directory of the process. The directory is opened
+// before checking that the process behind the pidfd is alive, so the directory
+// refers to the same process even if the process ID is reused later.
+func (p *Process) procDir() (int, error) {
+	if p == nil || p.Pidfd < 0 {
+		return -1, ErrProcessExited
+	}
+	dirfd, err := unix.Open(fmt.Sprintf("/proc/%d", p.Pid), unix.O_DIRECTORY|unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return -1, p.procError(err)
+	}
+	if err := unix.PidfdSendSignal(p.Pidfd, 0, nil, 0); err != nil {
+		unix.Close(dirfd)
+		return -1, p.procError(err)
+	}
+	return dirfd, nil
+}
+
+func (p *Process) readFile(name string) ([]byte, error) {
+	dirfd, err := p.procDir()
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(dirfd)
+	fd, err := unix.Openat(dirfd, name, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, p.procError(err)
+	}
+	f := os.NewFile(uintptr(fd), fmt.Sprintf("/proc/%d/%s", p.Pid, name))
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, p.procError(err)
+	}
+	return data, nil
+}
+
+// procError maps the errors of an exited process to ErrProcessExited
+func (p *Process) procError(err error) error {
+	if errors.Is(err, unix.ESRCH) || errors.Is(err, unix.ENOENT) {
+		return fmt.Errorf("%w: pid %d", ErrProcessExited, p.Pid)
+	}
+	return err
+}
@@ -0,0 +1,237 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// recursiveMask holds the events marked on every directory of a recursive watch
+// to follow the directories created, moved or deleted under the root.
+const recursiveMask = unix.FAN_CREATE |
+	unix.FAN_MOVED_FROM |
+	unix.FAN_MOVED_TO |
+	unix.FAN_DELETE |
+	unix.FAN_ONDIR |
+	unix.FAN_EVENT_ON_CHILD
+
+// recursiveWatch is a tree of directories added with AddRecursiveWatch
+type recursiveWatch struct {
+	root       string
+	eventTypes EventType
+}
+
+// recursiveDir is a directory marked as part of a recursive watch. The handle is
+// used to remove the mark once the directory is moved out of the tree and its
+// path is no longer known.
+type recursiveDir struct {
+	watch  *recursiveWatch
+	handle unix.FileHandle
+}
+
+func (w *recursiveWatch) mask() uint64 {
+	return uint64(w.eventTypes) | recursiveMask
+}
+
+// AddRecursiveWatch adds the directory root and every directory under it to the
+// watch list for the specified event types. Directories created or moved under
+// root later are marked as they appear and directories deleted or moved out of
+// root are unmarked.
+//
+// A directory created under root is only marked after its creation event is read,
+// so files created in it before then do not generate events. These entries, as well
+// as directories removed before they could be marked, are reported on the Errors
+// channel as [ErrRecursiveWatchRace] so that the caller can scan them.
+//
+// Recursive watches require the listener to report directory file identifiers and
+// names (unix.FAN_REPORT_DFID_NAME, the default on kernels 5.9 or later). Events of
+// directories themselves are only delivered if eventTypes includes
+// unix.FAN_ONDIR. The root is resolved if it is a symbolic link, but symbolic links
+// to directories under it are not followed.
+func (l *Listener) AddRecursiveWatch(root string, eventTypes EventType) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	if l.entireMount {
+		return os.ErrInvalid
+	}
+	if l.flags&unix.FAN_REPORT_NAME == 0 {
+		return fmt.Errorf("%w: recursive watches require unix.FAN_REPORT_DFID_NAME", ErrInvalidFlagCombination)
+	}
+	root, err := resolveRoot(root)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return &os.PathError{Op: "watch", Path: root, Err: unix.ENOTDIR}
+	}
+	return l.markTree(&recursiveWatch{root: root, eventTypes: eventTypes}, root, false)
+}
+
+// DeleteRecursiveWatch removes the marks of all directories added by
+// [Listener.AddRecursiveWatch] for root.
+func (l *Listener) DeleteRecursiveWatch(root string) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if resolved, err := resolveRoot(root); err == nil {
+		root = resolved
+	}
+	return l.unmarkTree(root, func(d *recursiveDir) bool {
+		return d.watch.root == root
+	})
+}
+
+// resolveRoot returns the absolute path of root with the symbolic links resolved,
+// as the paths of the events are resolved by the kernel. filepath.WalkDir does not
+// follow a root that is a symbolic link.
+func resolveRoot(root string) (string, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.EvalSymlinks(root)
+}
+
+// markTree marks dir and every directory under it. When the directory was just
+// created the entries found in it are reported as races, since their creation
+// events may have happened before the mark.
+func (l *Listener) markTree(w *recursiveWatch, dir string, created bool) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+			l.reportAsyncError(fmt.Errorf("%w: %s: %v", ErrRecursiveWatchRace, path, err))
+			return nil
+		}
+		if created && path != dir {
+			l.reportAsyncError(fmt.Errorf("%w: %s: created before its directory was marked", ErrRecursiveWatchRace, path))
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if err := l.markRecursiveDir(w, path); err != nil {
+			if path != dir && errors.Is(err, unix.ENOENT) {
+				l.reportAsyncError(fmt.Errorf("%w: %s: %v", ErrRecursiveWatchRace, path, err))
+				return fs.SkipDir
+			}
+			return err
+		}
+		return nil
+	})
+}
+
+func (l *Listener) markRecursiveDir(w *recursiveWatch, path string) error {
+	handle, _, err := unix.NameToHandleAt(unix.AT_FDCWD, path, 0)
+	if err != nil {
+		return &os.PathError{Op: "name_to_handle_at", Path: path, Err: err}
+	}
+	if err := l.fanotifyMark(path, unix.FAN_MARK_ADD|unix.FAN_MARK_ONLYDIR, w.mask()); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.recursive[path] = &recursiveDir{watch: w, handle: handle}
+	l.mu.Unlock()
+	return nil
+}
+
+// unmarkTree removes the marks of dir and the directories under it selected by
+// match. The marks are removed through the directory handles, as the directories
+// may have been moved elsewhere. Directories that no longer exist lost their marks
+// with their inodes and are only forgotten. Unprivileged listeners cannot open the
+// handles and remove the marks through the paths.
+func (l *Listener) unmarkTree(dir string, match func(*recursiveDir) bool) error {
+	dirs := make(map[string]*recursiveDir)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		return ErrListenerStopped
+	}
+	for path, d := range l.recursive {
+		if path != dir && !strings.HasPrefix(path, dir+"/") {
+			continue
+		}
+		if !match(d) {
+			continue
+		}
+		dirs[path] = d
+		delete(l.recursive, path)
+		delete(l.watches, markKey{path: path})
+		if l.unprivileged {
+			l.forgetHandle(path)
+		}
+	}
+	var firstErr error
+	for path, d := range dirs {
+		if l.unprivileged {
+			err := unix.FanotifyMark(l.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_ONLYDIR, d.watch.mask(), unix.AT_FDCWD, path)
+			if err != nil && err != unix.ENOENT && err != unix.ENOTDIR && firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		fd, err := unix.OpenByHandleAt(int(l.mountpoint.Fd()), d.handle, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_CLOEXEC)
+		if err != nil {
+			continue
+		}
+		err = unix.FanotifyMark(l.fd, unix.FAN_MARK_REMOVE|unix.FAN_MARK_ONLYDIR, d.watch.mask(), fd, "")
+		unix.Close(fd)
+		if err != nil && err != unix.ENOENT && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// handleRecursive follows the directories created, moved or deleted under the
+// recursive watches and reports whether the event was requested by the caller.
+// Events of directories outside recursive watches are always delivered.
+func (l *Listener) handleRecursive(mask uint64, event *Event) bool {
+	l.mu.Lock()
+	d, found := l.recursive[event.Path]
+	l.mu.Unlock()
+	if !found {
+		return true
+	}
+	isDir := mask&unix.FAN_ONDIR != 0
+	if isDir && event.FileName != "" && event.FileName != "." {
+		path := filepath.Join(event.Path, event.FileName)
+		if mask&(unix.FAN_DELETE|unix.FAN_MOVED_FROM) != 0 {
+			if err := l.unmarkTree(path, func(*recursiveDir) bool { return true }); err != nil {
+				l.reportError(fmt.Errorf("unmark %s: %w", path, err))
+			}
+		}
+		if mask&(unix.FAN_CREATE|unix.FAN_MOVED_TO) != 0 {
+			if err := l.markTree(d.watch, path, mask&unix.FAN_CREATE != 0); err != nil {
+				if errors.Is(err, unix.ENOENT) {
+					err = fmt.Errorf("%w: %s: %v", ErrRecursiveWatchRace, path, err)
+				}
+				l.reportError(err)
+			}
+		}
+	}
+	requested := d.watch.eventTypes
+	if isDir && !requested.Has(unix.FAN_ONDIR) {
+		return false
+	}
+	event.EventTypes &= requested
+	return event.EventTypes != 0
+}
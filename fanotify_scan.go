@@ -0,0 +1,378 @@
+//go:build linux
+// +build linux
+
+package fanotify
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// scanChunkSize is the size of the reads of PatternScanner
+const scanChunkSize = 64 << 10
+
+var (
+	// ErrInvalidSignature indicates a signature of a PatternScanner that cannot be parsed
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrScanFailed indicates a scanning daemon that could not scan a file or replied
+	// with an unexpected response
+	ErrScanFailed = errors.New("scan failed")
+	// ErrInfected is reported on the Errors channel for the files denied by
+	// [Listener.EnforceScanner]
+	ErrInfected = errors.New("infected file")
+)
+
+// ScanResult is the verdict of a Scanner on the content of a file.
+type ScanResult struct {
+	// Infected is true if the content matched a signature
+	Infected bool
+	// Signature is the name of the matched signature
+	Signature string
+}
+
+// Scanner inspects the content of the files of permission events.
+type Scanner interface {
+	// Scan inspects the content of f. The file duplicates the file descriptor of the
+	// event, is named after the path of the event and is closed once Scan returns.
+	// Reading the file does not generate events.
+	Scan(ctx context.Context, f *os.File) (ScanResult, error)
+}
+
+// Signature is a byte pattern matched by a PatternScanner.
+type Signature struct {
+	// Name identifies the signature in the scan results
+	Name string
+	// Hex holds the bytes to match as pairs of hex digits, optionally separated by
+	// spaces. The pair ?? matches any byte, as in the hex strings of YARA rules.
+	Hex string
+}
+
+// signature is a parsed Signature. mask is false for the wildcard bytes.
+type signature struct {
+	name    string
+	pattern []byte
+	mask    []bool
+}
+
+// PatternScanner is a Scanner matching the content of the files against byte patterns.
+type PatternScanner struct {
+	signatures []signature
+	maxLen     int
+}
+
+// NewPatternScanner returns a scanner reporting the files containing any of the signatures.
+//
+//	s, err := fanotify.NewPatternScanner(fanotify.Signature{
+//		Name: "elf-in-pdf",
+//		Hex:  "25 50 44 46 ?? ?? ?? ?? 7f 45 4c 46",
+//	})
+func NewPatternScanner(signatures ...Signature) (*PatternScanner, error) {
+	s := &PatternScanner{maxLen: 1}
+	for _, sig := range signatures {
+		parsed, err := parseSignature(sig)
+		if err != nil {
+			return nil, err
+		}
+		if len(parsed.pattern) > s.maxLen {
+			s.maxLen = len(parsed.pattern)
+		}
+		s.signatures = append(s.signatures, parsed)
+	}
+	return s, nil
+}
+
+func parseSignature(sig Signature) (signature, error) {
+	if sig.Name == "" {
+		return signature{}, fmt.Errorf("%w: missing name", ErrInvalidSignature)
+	}
+	digits := strings.Join(strings.Fields(sig.Hex), "")
+	if digits == "" || len(digits)%2 != 0 {
+		return signature{}, fmt.Errorf("%w: %s: malformed pattern %q", ErrInvalidSignature, sig.Name, sig.Hex)
+	}
+	parsed := signature{name: sig.Name}
+	literal := false
+	for i := 0; i < len(digits); i += 2 {
+		pair := digits[i : i+2]
+		if pair == "??" {
+			parsed.pattern = append(parsed.pattern, 0)
+			parsed.mask = append(parsed.mask, false)
+			continue
+		}
+		b, err := hex.DecodeString(pair)
+		if err != nil {
+			return signature{}, fmt.Errorf("%w: %s: malformed pattern %q", ErrInvalidSignature, sig.Name, sig.Hex)
+		}
+		parsed.pattern = append(parsed.pattern, b[0])
+		parsed.mask = append(parsed.mask, true)
+		literal = true
+	}
+	if !literal {
+		return signature{}, fmt.Errorf("%w: %s: the pattern matches any content", ErrInvalidSignature, sig.Name)
+	}
+	return parsed, nil
+}
+
+func (sig *signature) matchAt(data []byte, i int) bool {
+	if i+len(sig.pattern) > len(data) {
+		return false
+	}
+	for j, b := range sig.pattern {
+		if sig.mask[j] && data[i+j] != b {
+			return false
+		}
+	}
+	return true
+}
+
+// Scan reports the first signature found in the content of f.
+func (s *PatternScanner) Scan(ctx context.Context, f *os.File) (ScanResult, error) {
+	// the last maxLen-1 bytes of each chunk are kept for the patterns crossing chunks
+	buf := make([]byte, s.maxLen-1+scanChunkSize)
+	r := io.NewSectionReader(f, 0, math.MaxInt64)
+	kept := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return ScanResult{}, err
+		}
+		n, err := io.ReadFull(r, buf[kept:])
+		data := buf[:kept+n]
+		for i := range data {
+			for k := range s.signatures {
+				if s.signatures[k].matchAt(data, i) {
+					return ScanResult{Infected: true, Signature: s.signatures[k].name}, nil
+				}
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return ScanResult{}, nil
+		}
+		if err != nil {
+			return ScanResult{}, err
+		}
+		kept = s.maxLen - 1
+		copy(buf, data[len(data)-kept:])
+	}
+}
+
+// SocketScanner is a Scanner passing the files to a scanning daemon listening on a
+// Unix socket. The daemon must implement the FILDES command of the clamd protocol:
+// the file descriptor is sent with the command "nFILDES\n" and the daemon replies
+// with a single line, "<id>: OK" for clean files or "<id>: <signature> FOUND" for
+// infected files.
+type SocketScanner struct {
+	// Path is the path of the socket
+	Path string
+	// Timeout bounds each scan unless the context has an earlier deadline.
+	// Zero means no timeout.
+	Timeout time.Duration
+}
+
+// Scan sends f to the daemon and returns its verdict.
+func (s *SocketScanner) Scan(ctx context.Context, f *os.File) (ScanResult, error) {
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "unix", s.Path)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	rights := unix.UnixRights(int(f.Fd()))
+	if _, _, err := conn.(*net.UnixConn).WriteMsgUnix([]byte("nFILDES\n"), rights, nil); err != nil {
+		return ScanResult{}, err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("%w: %s: %v", ErrScanFailed, s.Path, err)
+	}
+	return parseScanReply(reply)
+}
+
+func parseScanReply(reply string) (ScanResult, error) {
+	reply = strings.TrimRight(reply, "\r\n")
+	i := strings.Index(reply, ": ")
+	if i < 0 {
+		return ScanResult{}, fmt.Errorf("%w: unexpected reply %q", ErrScanFailed, reply)
+	}
+	verdict := reply[i+2:]
+	switch {
+	case verdict == "OK":
+		return ScanResult{}, nil
+	case strings.HasSuffix(verdict, " FOUND"):
+		return ScanResult{Infected: true, Signature: strings.TrimSuffix(verdict, " FOUND")}, nil
+	default:
+		return ScanResult{}, fmt.Errorf("%w: %s", ErrScanFailed, verdict)
+	}
+}
+
+// fileID identifies a file regardless of its content
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+type scanEntry struct {
+	version fileVersion
+	result  ScanResult
+}
+
+// scanCache holds the scan results of the files until they are written. The
+// results are also discarded once the size or times of the files change, for
+// writers that keep the files open.
+type scanCache struct {
+	mu      sync.Mutex
+	entries map[fileID]scanEntry
+}
+
+func newScanCache() *scanCache {
+	return &scanCache{entries: make(map[fileID]scanEntry)}
+}
+
+func (c *scanCache) lookup(version fileVersion) (ScanResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, found := c.entries[fileID{version.dev, version.ino}]
+	if !found || entry.version != version {
+		return ScanResult{}, false
+	}
+	return entry.result, true
+}
+
+func (c *scanCache) store(version fileVersion, result ScanResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= maxCacheEntries {
+		c.entries = make(map[fileID]scanEntry)
+	}
+	c.entries[fileID{version.dev, version.ino}] = scanEntry{version: version, result: result}
+}
+
+// invalidate discards the result of the file open as fd
+func (c *scanCache) invalidate(fd int) {
+	var stat unix.Stat_t
+
+	if fd < 0 || unix.Fstat(fd, &stat) != nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, fileID{stat.Dev, stat.Ino})
+}
+
+// scan returns the verdict of the scanner on the file of the event. The file is
+// stat'ed and scanned through the same duplicate of the file descriptor of the
+// event, so that the cached verdict belongs to the file that was scanned even if
+// the event is closed concurrently and its file descriptor reused.
+func (c *scanCache) scan(ctx context.Context, s Scanner, e Event) (ScanResult, error) {
+	if e.Fd < 0 {
+		return ScanResult{}, fmt.Errorf("%w: event has no file descriptor", os.ErrInvalid)
+	}
+	dup, err := unix.FcntlInt(uintptr(e.Fd), unix.F_DUPFD_CLOEXEC, 0)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	f := os.NewFile(uintptr(dup), eventPath(e))
+	defer f.Close()
+	version, err := statVersion(dup)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	if result, found := c.lookup(version); found {
+		return result, nil
+	}
+	result, err := s.Scan(ctx, f)
+	if err != nil {
+		return ScanResult{}, err
+	}
+	c.store(version, result)
+	return result, nil
+}
+
+// isScannedEvent returns true for the permission events granting access to the
+// content of a file
+func isScannedEvent(eventTypes EventType) bool {
+	return eventTypes.Has(FileOpenPermission) ||
+		eventTypes.Has(FileAccessPermission) ||
+		eventTypes.Has(FileOpenToExecutePermission)
+}
+
+// EnforceScanner answers the [FileOpenPermission], [FileAccessPermission] and
+// [FileOpenToExecutePermission] events of the listener with the verdict of the
+// scanner on the content of the files, until the listener is stopped or ctx is done.
+// Infected files are denied and reported on the Errors channel as [ErrInfected];
+// files that cannot be scanned are denied and the error is reported. Other permission
+// events are allowed.
+//
+// The verdicts are cached until the files change. When the listener also watches
+// [FileClosedAfterWrite] events the verdict of a file is discarded as soon as it is
+// closed after writing. The file descriptor and the pidfd of each event are closed once
+// it is answered. EnforceScanner must be the only consumer of the Events and
+// PermissionEvents channels; notification events are discarded.
+//
+// Scanning large files delays the processes opening them. [WithPermissionTimeout]
+// bounds the delay.
+//
+//	l, err := fanotify.NewListener("/home", true, fanotify.PreContent)
+//	...
+//	err = l.WatchMount(fanotify.FileOpenPermission | fanotify.FileClosedAfterWrite)
+//	...
+//	go l.Start()
+//	err = l.EnforceScanner(ctx, &fanotify.SocketScanner{Path: "/run/clamav/clamd.ctl"})
+func (l *Listener) EnforceScanner(ctx context.Context, s Scanner) error {
+	if l == nil {
+		panic("nil listener")
+	}
+	cache := newScanCache()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-l.Events:
+			if !ok {
+				return nil
+			}
+			if e.EventTypes.Has(FileClosedAfterWrite) {
+				cache.invalidate(e.Fd)
+			}
+			e.closeFds()
+		case e, ok := <-l.PermissionEvents:
+			if !ok {
+				return nil
+			}
+			d := Allow
+			if isScannedEvent(e.EventTypes) {
+				result, err := cache.scan(ctx, s, e)
+				switch {
+				case err != nil:
+					l.reportAsyncError(fmt.Errorf("scan: %s: %w", eventPath(e), err))
+					d = Deny
+				case result.Infected:
+					l.reportAsyncError(fmt.Errorf("%w: %s: %s", ErrInfected, eventPath(e), result.Signature))
+					d = Deny
+				}
+			}
+			if err := l.Respond(e, d); err != nil {
+				l.reportAsyncError(fmt.Errorf("respond: %s: %w", eventPath(e), err))
+			}
+			e.Process.Close()
+		}
+	}
+}
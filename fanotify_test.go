@@ -1,15 +1,25 @@
 package fanotify
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
 )
 
 var bug = flag.Bool("bug", false, "run fanotify flag bug tests")
@@ -571,3 +581,1565 @@ func TestWithCapSysAdmMarkFileOrDirectoryOpenedBug(t *testing.T) {
 		t.Skip()
 	}
 }
+
+func TestWithCapSysAdmRunContextCancel(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	l.AddWatch(watchDir, FileCreated)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- l.Run(ctx)
+	}()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	_, err = runAsCmd("touch", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileCreated event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), testFile)
+	}
+	cancel()
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: Run did not return after context cancellation")
+	case err := <-result:
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+}
+
+func TestWithCapSysAdmStopUnblocksRun(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	result := make(chan error, 1)
+	go func() {
+		result <- l.Run(context.Background())
+	}()
+	time.Sleep(10 * time.Millisecond)
+	l.Stop()
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: Run did not return after Stop")
+	case err := <-result:
+		assert.Nil(t, err)
+	}
+	_, ok := <-l.Events
+	assert.False(t, ok)
+	assert.Equal(t, ErrListenerStopped, l.Run(context.Background()))
+	assert.Equal(t, ErrListenerStopped, l.AddWatch(t.TempDir(), FileCreated))
+	assert.Equal(t, ErrListenerStopped, l.ClearWatch())
+}
+
+func TestWithCapSysAdmRunContextCancelAllowsPending(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithPermissionEventBufferSize(0))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	// the events are queued before Run so that they are read at once; nobody
+	// receives them, so they are pending when Run returns
+	opened := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := runAsCmd("cat", testFile)
+			opened <- err
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error, 1)
+	go func() {
+		result <- l.Run(ctx)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: Run did not return after context cancellation")
+	case err := <-result:
+		assert.True(t, errors.Is(err, context.Canceled))
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timeout Error: the pending permission event was not answered")
+		case err := <-opened:
+			assert.Nil(t, err)
+		}
+	}
+}
+
+func TestWithCapSysAdmListenerOptions(t *testing.T) {
+	l, err := NewListenerWithOptions("/",
+		WithReportFlags(unix.FAN_REPORT_FID),
+		WithNoAtime(),
+		WithCloseOnExec(false),
+		WithEventBufferSize(8))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	assert.Equal(t, uint(unix.FAN_CLASS_NOTIF|unix.FAN_REPORT_FID), l.flags)
+	assert.Equal(t, uint(unix.O_RDONLY|unix.O_LARGEFILE|unix.O_NOATIME), l.eventFlags)
+	assert.Equal(t, 8, cap(l.Events))
+
+	_, err = NewListenerWithOptions("/", WithReportFlags(unix.FAN_CLASS_CONTENT))
+	assert.True(t, errors.Is(err, ErrInvalidFlagCombination))
+
+	_, err = NewListenerWithOptions("/",
+		WithPermissionType(PostContent),
+		WithReportFlags(unix.FAN_REPORT_FID))
+	assert.True(t, errors.Is(err, ErrInvalidFlagCombination))
+}
+
+func TestWithCapSysAdmQueueOverflow(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithReportFlags(0))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	for i := 0; i < 17000; i++ {
+		f, err := os.Create(fmt.Sprintf("%s/%d", watchDir, i))
+		assert.Nil(t, err)
+		f.Close()
+	}
+	l.AddWatch(watchDir, FileOpened)
+	// the default queue holds 16384 events; exceed it before the listener starts reading
+	for i := 0; i < 17000; i++ {
+		f, err := os.Open(fmt.Sprintf("%s/%d", watchDir, i))
+		assert.Nil(t, err)
+		f.Close()
+	}
+	go l.Start()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("Timeout Error: QueueOverflow event not received")
+		case event := <-l.Events:
+			if event.EventTypes.Has(QueueOverflow) {
+				assert.Equal(t, unix.FAN_NOFD, event.Fd)
+				return
+			}
+			unix.Close(event.Fd)
+		}
+	}
+}
+
+func TestWithCapSysAdmUnlimitedQueue(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithReportFlags(0), WithUnlimitedQueue(), WithUnlimitedMarks())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	assert.True(t, l.flags&unix.FAN_UNLIMITED_QUEUE == unix.FAN_UNLIMITED_QUEUE)
+	assert.True(t, l.flags&unix.FAN_UNLIMITED_MARKS == unix.FAN_UNLIMITED_MARKS)
+	watchDir := t.TempDir()
+	for i := 0; i < 17000; i++ {
+		f, err := os.Create(fmt.Sprintf("%s/%d", watchDir, i))
+		assert.Nil(t, err)
+		f.Close()
+	}
+	l.AddWatch(watchDir, FileOpened)
+	for i := 0; i < 17000; i++ {
+		f, err := os.Open(fmt.Sprintf("%s/%d", watchDir, i))
+		assert.Nil(t, err)
+		f.Close()
+	}
+	go l.Start()
+	for i := 0; i < 17000; i++ {
+		select {
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timeout Error: received %d of 17000 events", i)
+		case event := <-l.Events:
+			assert.False(t, event.EventTypes.Has(QueueOverflow))
+			unix.Close(event.Fd)
+		}
+	}
+}
+
+func TestWithCapSysAdmWatchFilesystem(t *testing.T) {
+	watchDir := t.TempDir()
+	l, err := NewListenerWithOptions(watchDir,
+		WithEntireMount(true),
+		WithReportFlags(unix.FAN_REPORT_DFID_NAME))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	err = l.WatchMount(FileCreated)
+	assert.True(t, errors.Is(err, ErrInvalidFlagCombination))
+	err = l.WatchFilesystem(FileCreated)
+	assert.Nil(t, err)
+	go l.Start()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	pid, err := runAsCmd("touch", testFile)
+	assert.Nil(t, err)
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-timeout:
+			t.Fatal("Timeout Error: FileCreated event not received")
+		case event := <-l.Events:
+			unix.Close(event.Fd)
+			if fmt.Sprintf("%s/%s", event.Path, event.FileName) != testFile {
+				// events from elsewhere on the filesystem
+				continue
+			}
+			assert.Equal(t, event.Pid, pid)
+			assert.True(t, event.EventTypes.Has(FileCreated))
+			assert.Nil(t, l.UnwatchFilesystem(FileCreated))
+			assert.Nil(t, l.ClearWatch())
+			return
+		}
+	}
+}
+
+func TestWatchFilesystemRequiresEntireMount(t *testing.T) {
+	l := &Listener{}
+	assert.Equal(t, ErrWatchPath, l.WatchFilesystem(FileCreated))
+	assert.Equal(t, ErrWatchPath, l.UnwatchFilesystem(FileCreated))
+}
+
+func TestMarkMaskValid(t *testing.T) {
+	assert.NotNil(t, isFanotifyMarkMaskValid(unix.FAN_REPORT_FID, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_MOVED_TO))
+	assert.NotNil(t, isFanotifyMarkMaskValid(0, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, unix.FAN_CREATE))
+	assert.Nil(t, isFanotifyMarkMaskValid(unix.FAN_REPORT_FID, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, unix.FAN_CREATE))
+	assert.Nil(t, isFanotifyMarkMaskValid(0, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_MODIFY))
+}
+
+func TestKernelSupport(t *testing.T) {
+	assert.Nil(t, fanotifyInitFlagsKernelSupport(unix.FAN_CLASS_NOTIF, versionFeatures(4, 19)))
+	assert.Nil(t, fanotifyInitFlagsKernelSupport(unix.FAN_REPORT_DFID_NAME, versionFeatures(5, 9)))
+	err := fanotifyInitFlagsKernelSupport(unix.FAN_REPORT_FID|unix.FAN_REPORT_PIDFD, versionFeatures(5, 10))
+	assert.True(t, errors.Is(err, ErrUnsupportedOnKernelVersion))
+	assert.Contains(t, err.Error(), "FAN_REPORT_PIDFD")
+	assert.Contains(t, err.Error(), "requires Linux kernel 5.15")
+	targetFid := uint(unix.FAN_REPORT_FID | unix.FAN_REPORT_DFID_NAME | unix.FAN_REPORT_TARGET_FID)
+	assert.Nil(t, fanotifyInitFlagsKernelSupport(targetFid, versionFeatures(5, 17)))
+	err = fanotifyInitFlagsKernelSupport(targetFid, versionFeatures(5, 16))
+	assert.True(t, errors.Is(err, ErrUnsupportedOnKernelVersion))
+	assert.Contains(t, err.Error(), "FAN_REPORT_TARGET_FID")
+	assert.NotNil(t, flagsValid(unix.FAN_REPORT_TARGET_FID|unix.FAN_REPORT_FID))
+	assert.Nil(t, flagsValid(targetFid))
+
+	assert.Nil(t, fanotifyMarkFlagsKernelSupport(uint64(FileModified), versionFeatures(4, 19)))
+	err = fanotifyMarkFlagsKernelSupport(uint64(FileCreated), versionFeatures(4, 19))
+	assert.True(t, errors.Is(err, ErrUnsupportedOnKernelVersion))
+	assert.Contains(t, err.Error(), "FAN_CREATE")
+	assert.Contains(t, err.Error(), "requires Linux kernel 5.1")
+	assert.Nil(t, fanotifyMarkFlagsKernelSupport(uint64(FilePreAccess), versionFeatures(6, 14)))
+	err = fanotifyMarkFlagsKernelSupport(uint64(FilePreAccess), versionFeatures(6, 13))
+	assert.True(t, errors.Is(err, ErrUnsupportedOnKernelVersion))
+	assert.Contains(t, err.Error(), "FAN_PRE_ACCESS")
+
+	assert.Nil(t, fanotifyMarkTypeKernelSupport(unix.FAN_MARK_MOUNT, versionFeatures(4, 19)))
+	err = fanotifyMarkTypeKernelSupport(unix.FAN_MARK_FILESYSTEM, versionFeatures(4, 19))
+	assert.True(t, errors.Is(err, ErrUnsupportedOnKernelVersion))
+	assert.Contains(t, err.Error(), "FAN_MARK_FILESYSTEM")
+	assert.Contains(t, err.Error(), "requires Linux kernel 4.20")
+}
+
+func TestParseKernelRelease(t *testing.T) {
+	tests := []struct {
+		release  string
+		maj, min int
+		valid    bool
+	}{
+		{"5.14.0-362.el9.x86_64", 5, 14, true},
+		{"4.12.14-122.37-default", 4, 12, true},
+		{"6.1", 6, 1, true},
+		{"6", 6, 0, true},
+		{"", 0, 0, false},
+		{"linux", 0, 0, false},
+	}
+	for _, test := range tests {
+		maj, min, err := parseKernelRelease(test.release)
+		if !test.valid {
+			assert.NotNil(t, err, test.release)
+			continue
+		}
+		assert.Nil(t, err, test.release)
+		assert.Equal(t, test.maj, maj, test.release)
+		assert.Equal(t, test.min, min, test.release)
+	}
+}
+
+func TestWithCapSysAdmFeatures(t *testing.T) {
+	f, err := Features()
+	assert.Nil(t, err)
+	assert.True(t, f.Probed)
+	assert.True(t, f.HasInitFlags(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC))
+	assert.True(t, f.HasEvents(FileModified|FileAccessed))
+	maj, min, err := kernelVersion()
+	assert.Nil(t, err)
+	// backported features may be probed on older kernels, never the opposite
+	expected := versionFeatures(maj, min)
+	assert.True(t, f.HasInitFlags(expected.InitFlags&^unix.FAN_ENABLE_AUDIT))
+	assert.True(t, f.HasMarkFlags(expected.MarkFlags))
+	assert.True(t, f.HasEvents(expected.Events))
+}
+
+func TestWithCapSysAdmAddIgnore(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	noisyFile := fmt.Sprintf("%s/noisy.log", watchDir)
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(noisyFile, []byte("noise"), 0666))
+	assert.Nil(t, os.WriteFile(testFile, []byte("data"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileModified))
+	assert.Nil(t, l.AddIgnore(noisyFile, FileModified))
+	go l.Start()
+
+	pid, err := runAsCmd("touch", "-m", noisyFile)
+	assert.Nil(t, err)
+	pid, err = runAsCmd("touch", "-m", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileModified event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), testFile)
+		assert.Equal(t, event.Pid, pid)
+	}
+
+	assert.Nil(t, l.RemoveIgnore(noisyFile, FileModified))
+	pid, err = runAsCmd("touch", "-m", noisyFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileModified event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), noisyFile)
+		assert.Equal(t, event.Pid, pid)
+	}
+
+	assert.Nil(t, l.AddIgnore(noisyFile, FileModified))
+	assert.Nil(t, l.ClearWatch())
+	assert.Equal(t, 0, len(l.watches))
+}
+
+func TestWithCapSysAdmFanotifyFileRenamed(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	srcDir := t.TempDir()
+	dstDir := t.TempDir()
+	oldFile := fmt.Sprintf("%s/old.txt", srcDir)
+	newFile := fmt.Sprintf("%s/new.txt", dstDir)
+	_, err = runAsCmd("touch", oldFile)
+	assert.Nil(t, err)
+	assert.Nil(t, l.AddWatch(srcDir, FileRenamed))
+	assert.Nil(t, l.AddWatch(dstDir, FileRenamed))
+	go l.Start()
+	pid, err := runAsCmd("mv", oldFile, newFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileRenamed event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.OldPath, event.OldFileName), oldFile)
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.NewPath, event.NewFileName), newFile)
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), newFile)
+		assert.Equal(t, event.Pid, pid)
+		assert.True(t, event.EventTypes.Has(FileRenamed))
+		t.Logf("Received: (%s)", event)
+	}
+}
+
+// infoRecord encodes an information record as reported by the kernel
+func infoRecord(infoType InfoType, fields ...interface{}) []byte {
+	body := new(bytes.Buffer)
+	for _, f := range fields {
+		binary.Write(body, binary.LittleEndian, f)
+	}
+	for body.Len()%4 != 0 {
+		body.WriteByte(0)
+	}
+	record := new(bytes.Buffer)
+	record.WriteByte(uint8(infoType))
+	record.WriteByte(0)
+	binary.Write(record, binary.LittleEndian, uint16(4+body.Len()))
+	record.Write(body.Bytes())
+	return record.Bytes()
+}
+
+func TestParseInfoRecords(t *testing.T) {
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fsid := [2]int32{11, 12}
+	var buf []byte
+	buf = append(buf, infoRecord(InfoDFIDName, fsid, uint32(len(handle)), int32(1), handle, []byte("test.txt\x00"))...)
+	buf = append(buf, infoRecord(InfoFID, fsid, uint32(len(handle)), int32(1), handle)...)
+	buf = append(buf, infoRecord(InfoPIDFD, int32(42))...)
+	buf = append(buf, infoRecord(InfoError, int32(unix.EIO), uint32(3))...)
+	buf = append(buf, infoRecord(InfoRange, uint32(0), uint64(4096), uint64(512))...)
+	records, err := parseInfoRecords(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(records))
+
+	assert.Equal(t, InfoDFIDName, records[0].Type)
+	assert.Equal(t, fsid, records[0].Fsid.Val)
+	assert.Equal(t, int32(1), records[0].Handle.Type())
+	assert.Equal(t, handle, records[0].Handle.Bytes())
+	assert.Equal(t, "test.txt", records[0].Name)
+
+	assert.Equal(t, InfoFID, records[1].Type)
+	assert.Equal(t, handle, records[1].Handle.Bytes())
+	assert.Equal(t, "", records[1].Name)
+
+	assert.Equal(t, InfoPIDFD, records[2].Type)
+	assert.Equal(t, 42, records[2].Pidfd)
+
+	assert.Equal(t, InfoError, records[3].Type)
+	assert.Equal(t, int32(unix.EIO), records[3].Error)
+	assert.Equal(t, uint32(3), records[3].ErrorCount)
+
+	assert.Equal(t, InfoRange, records[4].Type)
+	assert.Equal(t, int64(4096), records[4].Offset)
+	assert.Equal(t, int64(512), records[4].Count)
+
+	// truncated record
+	_, err = parseInfoRecords(buf[:len(buf)-2])
+	assert.True(t, errors.Is(err, errMalformedEvent))
+	// handle size beyond the record
+	_, err = parseInfoRecords(infoRecord(InfoFID, fsid, uint32(64), int32(1), handle))
+	assert.True(t, errors.Is(err, errMalformedEvent))
+}
+
+func TestWithCapSysAdmReportPidfd(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithReportPidfd())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("data"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileModified))
+	go l.Start()
+
+	f, err := os.OpenFile(testFile, os.O_WRONLY, 0)
+	assert.Nil(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("more data"))
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileModified event not received")
+	case event := <-l.Events:
+		defer event.Process.Close()
+		assert.Equal(t, os.Getpid(), event.Process.Pid)
+		exe, err := os.Executable()
+		assert.Nil(t, err)
+		processExe, err := event.Process.Exe()
+		assert.Nil(t, err)
+		assert.Equal(t, exe, processExe)
+		cmdline, err := event.Process.Cmdline()
+		assert.Nil(t, err)
+		assert.Equal(t, os.Args, cmdline)
+		uid, err := event.Process.UID()
+		assert.Nil(t, err)
+		assert.Equal(t, os.Getuid(), uid)
+		_, err = event.Process.Comm()
+		assert.Nil(t, err)
+	}
+
+	_, err = runAsCmd("touch", "-m", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileModified event not received")
+	case event := <-l.Events:
+		defer event.Process.Close()
+		_, err := event.Process.Comm()
+		assert.True(t, errors.Is(err, ErrProcessExited))
+	}
+}
+
+func TestWithCapSysAdmReportTid(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithReportTid())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("data"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileModified))
+	go l.Start()
+
+	tids := make(chan int, 1)
+	go func() {
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		f, err := os.OpenFile(testFile, os.O_WRONLY, 0)
+		assert.Nil(t, err)
+		defer f.Close()
+		f.Write([]byte("more data"))
+		tids <- unix.Gettid()
+	}()
+	tid := <-tids
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileModified event not received")
+	case event := <-l.Events:
+		assert.Equal(t, tid, event.Tid)
+		assert.Equal(t, tid, event.Pid)
+	}
+	_, err = NewListenerWithOptions("/", WithReportTid(), WithReportPidfd())
+	assert.True(t, errors.Is(err, ErrInvalidFlagCombination))
+}
+
+func TestFilesystemErrorEvent(t *testing.T) {
+	var buf bytes.Buffer
+	handle := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	fsid := [2]int32{11, 12}
+	records := append(infoRecord(InfoError, int32(unix.EUCLEAN), uint32(2)),
+		infoRecord(InfoFID, fsid, uint32(len(handle)), int32(1), handle)...)
+	metadata := unix.FanotifyEventMetadata{
+		Event_len:    sizeOfFanotifyEventMetadata + uint32(len(records)),
+		Vers:         unix.FANOTIFY_METADATA_VERSION,
+		Metadata_len: uint16(sizeOfFanotifyEventMetadata),
+		Mask:         unix.FAN_FS_ERROR,
+		Fd:           unix.FAN_NOFD,
+	}
+	binary.Write(&buf, binary.LittleEndian, &metadata)
+	buf.Write(records)
+	l := &Listener{}
+	event, err := l.newEvent(&metadata, buf.Bytes())
+	assert.Nil(t, err)
+	assert.True(t, event.EventTypes.Has(FilesystemError))
+	assert.Equal(t, unix.FAN_NOFD, event.Fd)
+	assert.Equal(t, unix.EUCLEAN, event.Errno)
+	assert.Equal(t, uint32(2), event.ErrorCount)
+	assert.Equal(t, handle, event.FileHandle.Bytes())
+
+	assert.NotNil(t, isFanotifyMarkMaskValid(unix.FAN_REPORT_FID, unix.FAN_MARK_ADD|unix.FAN_MARK_MOUNT, unix.FAN_FS_ERROR))
+	assert.NotNil(t, isFanotifyMarkMaskValid(0, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, unix.FAN_FS_ERROR))
+	assert.Nil(t, isFanotifyMarkMaskValid(unix.FAN_REPORT_FID, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, unix.FAN_FS_ERROR))
+}
+
+func TestWithCapSysAdmWatchFilesystemError(t *testing.T) {
+	l, err := NewListenerWithOptions(t.TempDir(),
+		WithEntireMount(true),
+		WithReportFlags(unix.FAN_REPORT_FID))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	assert.True(t, errors.Is(l.WatchMount(FilesystemError), ErrInvalidFlagCombination))
+	assert.Nil(t, l.WatchFilesystem(FilesystemError))
+}
+
+// recursiveDirMarked reports whether dir is marked by a recursive watch
+func recursiveDirMarked(l *Listener, dir string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, found := l.recursive[dir]
+	return found
+}
+
+func TestWithCapSysAdmAddRecursiveWatch(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	if l.flags&unix.FAN_REPORT_NAME == 0 {
+		t.Skip("recursive watches require FAN_REPORT_DFID_NAME")
+	}
+	root := t.TempDir()
+	outside := t.TempDir()
+	nestedDir := fmt.Sprintf("%s/a/b", root)
+	newDir := fmt.Sprintf("%s/c", root)
+	movedDir := fmt.Sprintf("%s/c", outside)
+	assert.Nil(t, os.MkdirAll(nestedDir, 0755))
+	assert.Nil(t, l.AddRecursiveWatch(root, FileCreated))
+	assert.True(t, recursiveDirMarked(l, root))
+	assert.True(t, recursiveDirMarked(l, nestedDir))
+	go l.Start()
+
+	// files created in existing directories
+	testFile := fmt.Sprintf("%s/test.txt", nestedDir)
+	pid, err := runAsCmd("touch", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileCreated event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), testFile)
+		assert.Equal(t, event.Pid, pid)
+	}
+
+	// directories created later are marked; their own creation is not delivered
+	assert.Nil(t, os.Mkdir(newDir, 0755))
+	assert.Eventually(t, func() bool { return recursiveDirMarked(l, newDir) }, time.Second, 10*time.Millisecond)
+	testFile = fmt.Sprintf("%s/test.txt", newDir)
+	pid, err = runAsCmd("touch", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileCreated event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), testFile)
+		assert.Equal(t, event.Pid, pid)
+	}
+
+	// directories moved out are unmarked
+	assert.Nil(t, os.Rename(newDir, movedDir))
+	assert.Eventually(t, func() bool { return !recursiveDirMarked(l, newDir) }, time.Second, 10*time.Millisecond)
+	_, err = runAsCmd("touch", fmt.Sprintf("%s/moved.txt", movedDir))
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+	case event := <-l.Events:
+		t.Errorf("Unexpected event for a directory moved out: (%s)", event)
+	}
+
+	assert.Nil(t, l.DeleteRecursiveWatch(root))
+	assert.False(t, recursiveDirMarked(l, root))
+	assert.False(t, recursiveDirMarked(l, nestedDir))
+}
+
+func TestWithCapSysAdmAddRecursiveWatchSymlink(t *testing.T) {
+	l, err := NewListener("/", false, PermissionNone)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	if l.flags&unix.FAN_REPORT_NAME == 0 {
+		t.Skip("recursive watches require FAN_REPORT_DFID_NAME")
+	}
+	root := t.TempDir()
+	nestedDir := fmt.Sprintf("%s/sub", root)
+	assert.Nil(t, os.Mkdir(nestedDir, 0755))
+	link := fmt.Sprintf("%s/link", t.TempDir())
+	assert.Nil(t, os.Symlink(root, link))
+	assert.Nil(t, l.AddRecursiveWatch(link, FileCreated))
+	assert.True(t, recursiveDirMarked(l, root))
+	assert.True(t, recursiveDirMarked(l, nestedDir))
+	go l.Start()
+
+	testFile := fmt.Sprintf("%s/test.txt", nestedDir)
+	_, err = runAsCmd("touch", fmt.Sprintf("%s/sub/test.txt", link))
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileCreated event not received")
+	case event := <-l.Events:
+		assert.Equal(t, fmt.Sprintf("%s/%s", event.Path, event.FileName), testFile)
+	}
+
+	assert.Nil(t, l.DeleteRecursiveWatch(link))
+	assert.False(t, recursiveDirMarked(l, root))
+	assert.False(t, recursiveDirMarked(l, nestedDir))
+}
+
+func TestUnprivilegedOptions(t *testing.T) {
+	tests := []struct {
+		opts []Option
+		err  error
+	}{
+		{[]Option{WithPermissionType(PreContent)}, ErrCapSysAdmin},
+		{[]Option{WithEntireMount(true)}, ErrCapSysAdmin},
+		{[]Option{WithUnlimitedQueue()}, ErrCapSysAdmin},
+		{[]Option{WithUnlimitedMarks()}, ErrCapSysAdmin},
+		{[]Option{WithReportPidfd()}, ErrCapSysAdmin},
+		{[]Option{WithReportTid()}, ErrCapSysAdmin},
+		{[]Option{WithEnableAudit()}, ErrCapSysAdmin},
+		{[]Option{WithReportFlags(0)}, ErrInvalidFlagCombination},
+	}
+	for _, test := range tests {
+		l, err := NewListenerWithOptions("/", append(test.opts, WithUnprivileged())...)
+		assert.Nil(t, l)
+		assert.True(t, errors.Is(err, test.err), err)
+	}
+}
+
+func TestWithCapSysAdmUnprivileged(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithUnprivileged())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.True(t, errors.Is(l.WatchMount(FileModified), ErrCapSysAdmin))
+	assert.Nil(t, l.AddWatch(watchDir, FileCreated))
+	go l.Start()
+	_, err = runAsCmd("touch", testFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(100 * time.Millisecond):
+		t.Error("Timeout Error: FileCreated event not received")
+	case event := <-l.Events:
+		assert.Equal(t, watchDir, event.Path)
+		assert.Equal(t, "test.txt", event.FileName)
+		assert.Equal(t, unix.FAN_NOFD, event.Fd)
+		assert.True(t, event.EventTypes.Has(FileCreated))
+	}
+	assert.Nil(t, l.DeleteWatch(watchDir, FileCreated))
+	assert.Equal(t, 0, len(l.handles))
+}
+
+func TestWithCapSysAdmRespond(t *testing.T) {
+	l, err := NewListener("/", false, PostContent)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	go l.Start()
+
+	for _, d := range []Decision{Deny, Allow} {
+		result := make(chan error, 1)
+		go func() {
+			_, err := runAsCmd("cat", testFile)
+			result <- err
+		}()
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timeout Error: FileOpenPermission event not received")
+		case event := <-l.PermissionEvents:
+			assert.True(t, event.EventTypes.Has(FileOpenPermission))
+			assert.True(t, errors.Is(l.Respond(event, d.WithAudit()), ErrInvalidFlagCombination))
+			assert.True(t, errors.Is(l.Respond(event, Decision(0)), ErrInvalidFlagCombination))
+			_, err := unix.FcntlInt(uintptr(event.Fd), unix.F_GETFD, 0)
+			assert.Nil(t, err)
+			assert.Nil(t, l.Respond(event, d))
+			_, err = unix.FcntlInt(uintptr(event.Fd), unix.F_GETFD, 0)
+			assert.Equal(t, unix.EBADF, err)
+			// the kernel rejects a second response to the event
+			assert.NotNil(t, l.Respond(event, d))
+		}
+		err := <-result
+		if d == Deny {
+			assert.NotNil(t, err)
+		} else {
+			assert.Nil(t, err)
+		}
+	}
+
+	// closing the notification group allows the pending events
+	result := make(chan error, 1)
+	go func() {
+		_, err := runAsCmd("cat", testFile)
+		result <- err
+	}()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: FileOpenPermission event not received")
+	case event := <-l.PermissionEvents:
+		l.Stop()
+		assert.True(t, errors.Is(l.Respond(event, Deny), ErrListenerStopped))
+	}
+	assert.Nil(t, <-result)
+}
+
+func TestCheckDecision(t *testing.T) {
+	features := FeatureSet{DenyErrno: true}
+	var preContent, postContent uint = unix.FAN_CLASS_PRE_CONTENT, unix.FAN_CLASS_CONTENT
+	assert.Nil(t, checkDecision(preContent, features, Allow))
+	assert.Nil(t, checkDecision(preContent, features, DenyWithErrno(unix.ETXTBSY)))
+	assert.True(t, errors.Is(checkDecision(preContent, features, Decision(0)), ErrInvalidFlagCombination))
+	assert.True(t, errors.Is(checkDecision(preContent, features, Allow|Deny), ErrInvalidFlagCombination))
+	assert.True(t, errors.Is(checkDecision(preContent, features, Allow|fanInfo), ErrInvalidFlagCombination))
+	assert.Equal(t, Deny|Decision(unix.ETXTBSY)<<24, DenyWithErrno(unix.ETXTBSY))
+	assert.True(t, errors.Is(checkDecision(preContent, features, DenyWithErrno(unix.EACCES)), ErrInvalidFlagCombination))
+	assert.True(t, errors.Is(checkDecision(preContent, features, Allow|Decision(unix.EIO)<<24), ErrInvalidFlagCombination))
+	assert.True(t, errors.Is(checkDecision(preContent, features, Deny.WithAudit()), ErrInvalidFlagCombination))
+	assert.True(t, errors.Is(checkDecision(postContent, features, DenyWithErrno(unix.EIO)), ErrInvalidFlagCombination))
+	features.DenyErrno = false
+	assert.True(t, errors.Is(checkDecision(preContent, features, DenyWithErrno(unix.EIO)), ErrUnsupportedOnKernelVersion))
+}
+
+func TestWithCapSysAdmDenyWithErrno(t *testing.T) {
+	l, err := NewListener("/", false, PreContent)
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	if !l.features.DenyErrno || !l.features.ResponseInfo {
+		t.Skip("denying with an errno requires Linux kernel 6.14 or later")
+	}
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	go l.Start()
+
+	rules := []struct {
+		decision Decision
+		errno    error
+	}{
+		{DenyWithErrno(unix.ETXTBSY), unix.ETXTBSY},
+		{Allow, nil},
+	}
+	for i, rule := range rules {
+		result := make(chan error, 1)
+		go func() {
+			fd, err := unix.Open(testFile, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+			if err == nil {
+				unix.Close(fd)
+			}
+			result <- err
+		}()
+		select {
+		case <-time.After(time.Second):
+			t.Fatal("Timeout Error: FileOpenPermission event not received")
+		case event := <-l.PermissionEvents:
+			assert.Nil(t, l.RespondWithAuditRule(event, rule.decision, AuditRule{RuleNumber: uint32(i + 1), SubjectTrust: 2, ObjectTrust: 2}))
+		}
+		assert.Equal(t, rule.errno, <-result)
+	}
+}
+
+func TestWithCapSysAdmPermissionTimeout(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithPermissionTimeout(50*time.Millisecond, Deny))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	go l.Start()
+
+	open := func() chan error {
+		result := make(chan error, 1)
+		go func() {
+			_, err := runAsCmd("cat", testFile)
+			result <- err
+		}()
+		return result
+	}
+
+	// the handler stalls past the deadline
+	result := open()
+	var event Event
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: FileOpenPermission event not received")
+	case event = <-l.PermissionEvents:
+	}
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: default decision not sent")
+	case err := <-result:
+		assert.NotNil(t, err)
+	}
+	// the file descriptor stays open until the event is responded to
+	_, err = unix.FcntlInt(uintptr(event.Fd), unix.F_GETFD, 0)
+	assert.Nil(t, err)
+	assert.True(t, errors.Is(l.Respond(event, Allow), ErrPermissionTimeout))
+	_, err = unix.FcntlInt(uintptr(event.Fd), unix.F_GETFD, 0)
+	assert.Equal(t, unix.EBADF, err)
+	assert.Equal(t, uint64(1), l.PermissionTimeouts())
+	select {
+	case err := <-l.Errors:
+		assert.True(t, errors.Is(err, ErrPermissionTimeout))
+	default:
+		t.Error("timeout not reported on the Errors channel")
+	}
+
+	// the handler responds in time
+	result = open()
+	select {
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: FileOpenPermission event not received")
+	case event = <-l.PermissionEvents:
+		assert.Nil(t, l.Respond(event, Allow))
+	}
+	assert.Nil(t, <-result)
+	assert.Equal(t, uint64(1), l.PermissionTimeouts())
+}
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"/tmp/*", "/tmp/a.sh", true},
+		{"/tmp/*", "/tmp/dir/a.sh", false},
+		{"/tmp/**", "/tmp/dir/a.sh", true},
+		{"/home/**/*.sh", "/home/a.sh", true},
+		{"/home/**/*.sh", "/home/user/bin/a.sh", true},
+		{"/home/**/*.sh", "/home/user/bin/a.py", false},
+		{"/usr/bin/python3.?", "/usr/bin/python3.9", true},
+		{"/usr/bin/python3.?", "/usr/bin/python3x9", false},
+		{"/dev/sd[a-c]", "/dev/sdb", true},
+		{"/dev/sd[^a-c]", "/dev/sdb", false},
+		{"/a\\*b", "/a*b", true},
+		{"/a\\*b", "/axb", false},
+	}
+	for _, test := range tests {
+		re, err := compileGlob(test.pattern)
+		assert.Nil(t, err, test.pattern)
+		assert.Equal(t, test.match, re.MatchString(test.name), "%s %s", test.pattern, test.name)
+	}
+	for _, pattern := range []string{"/dev/sd[", "/dev/sd[]", "/tmp/\\"} {
+		_, err := compileGlob(pattern)
+		assert.NotNil(t, err, pattern)
+	}
+}
+
+func TestLoadPolicy(t *testing.T) {
+	p, err := LoadPolicy(strings.NewReader(`{
+		"default": "deny",
+		"rules": [
+			{"name": "no-exec-from-tmp", "path": "/tmp/**", "eventTypes": ["FileOpenToExecutePermission"], "decision": "deny", "errno": "EIO"},
+			{"name": "root", "uids": [0], "decision": "allow", "audit": true}
+		]
+	}`))
+	assert.Nil(t, err)
+	assert.Equal(t, Deny, p.Default())
+	assert.Equal(t, 2, len(p.rules))
+	assert.Equal(t, FileOpenToExecutePermission, p.rules[0].EventTypes)
+	assert.Equal(t, DenyWithErrno(unix.EIO), p.rules[0].Decision)
+	assert.Equal(t, []int{0}, p.rules[1].UIDs)
+	assert.Equal(t, Allow.WithAudit(), p.rules[1].Decision)
+
+	for _, policy := range []string{
+		`{"default": "maybe"}`,
+		`{"default": "allow", "rules": [{"decision": "allow", "eventTypes": ["FileOpened"]}]}`,
+		`{"default": "allow", "rules": [{"decision": "allow", "errno": "EIO"}]}`,
+		`{"default": "allow", "rules": [{"decision": "deny", "errno": "EACCES"}]}`,
+		`{"default": "allow", "rules": [{"decision": "deny", "sha256": ["abcd"]}]}`,
+		`{"default": "allow", "rules": [{"decision": "deny", "path": "/tmp/["}]}`,
+		`{"default": "allow", "rules": [{"decision": "deny", "user": "root"}]}`,
+	} {
+		_, err := LoadPolicy(strings.NewReader(policy))
+		assert.True(t, errors.Is(err, ErrInvalidPolicy), policy)
+	}
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	testFile := fmt.Sprintf("%s/test.sh", t.TempDir())
+	content := []byte("#!/bin/sh\necho test\n")
+	assert.Nil(t, os.WriteFile(testFile, content, 0755))
+	digest := sha256.Sum256(content)
+	exe, err := os.Executable()
+	assert.Nil(t, err)
+
+	fd, err := unix.Open(testFile, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	assert.Nil(t, err)
+	defer unix.Close(fd)
+	event := Event{Fd: fd, Path: testFile, Pid: os.Getpid(), EventTypes: FileOpenToExecutePermission}
+
+	p, err := NewPolicy(Deny,
+		Rule{Name: "other-exe", Exe: "/nonexistent/*", Decision: Allow},
+		Rule{Name: "open-only", EventTypes: FileOpenPermission, Decision: Allow},
+		Rule{Name: "known-script", Path: "/**/*.sh", Exe: exe, UIDs: []int{os.Getuid()}, SHA256: []string{hex.EncodeToString(digest[:])}, Decision: Allow},
+	)
+	assert.Nil(t, err)
+	d, rule, err := p.Evaluate(event)
+	assert.Nil(t, err)
+	assert.Equal(t, Allow, d)
+	assert.NotNil(t, rule)
+	assert.Equal(t, "known-script", rule.Name)
+
+	// the file descriptor offset is not changed by hashing the file
+	offset, err := unix.Seek(fd, 0, io.SeekCurrent)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), offset)
+
+	// modified content no longer matches
+	assert.Nil(t, os.WriteFile(testFile, []byte("#!/bin/sh\nrm -rf /\n"), 0755))
+	d, rule, err = p.Evaluate(event)
+	assert.Nil(t, err)
+	assert.Equal(t, Deny, d)
+	assert.Nil(t, rule)
+
+	// conditions that cannot be evaluated return the default decision
+	event.Pid = 0x7ffffff0
+	d, rule, err = p.Evaluate(event)
+	assert.NotNil(t, err)
+	assert.Equal(t, Deny, d)
+	assert.Nil(t, rule)
+
+	// decisions that are neither Allow nor Deny are rejected
+	_, err = NewPolicy(Allow, Rule{Name: "zero"})
+	assert.True(t, errors.Is(err, ErrInvalidPolicy))
+	_, err = NewPolicy(Allow | Deny)
+	assert.True(t, errors.Is(err, ErrInvalidPolicy))
+}
+
+// openFds returns the number of file descriptors open in the process
+func openFds(t *testing.T) int {
+	entries, err := os.ReadDir("/proc/self/fd")
+	assert.Nil(t, err)
+	return len(entries)
+}
+
+func TestWithCapSysAdmEnforcePolicy(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithReportPidfd())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	secretFile := fmt.Sprintf("%s/secret.key", watchDir)
+	publicFile := fmt.Sprintf("%s/public.txt", watchDir)
+	logFile := fmt.Sprintf("%s/test.log", watchDir)
+	assert.Nil(t, os.WriteFile(secretFile, []byte("secret"), 0666))
+	assert.Nil(t, os.WriteFile(publicFile, []byte("public"), 0666))
+	assert.Nil(t, os.WriteFile(logFile, []byte("log"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	p, err := NewPolicy(Allow,
+		Rule{Name: "keys", Path: "/**/*.key", Decision: Deny},
+		// PostContent listeners cannot deny with an errno
+		Rule{Name: "logs", Path: "/**/*.log", Decision: DenyWithErrno(unix.EIO)},
+	)
+	assert.Nil(t, err)
+	go l.Start()
+	fds := openFds(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.EnforcePolicy(ctx, p)
+	}()
+
+	_, err = runAsCmd("cat", secretFile)
+	assert.NotNil(t, err)
+	_, err = runAsCmd("cat", publicFile)
+	assert.Nil(t, err)
+	_, err = runAsCmd("cat", logFile)
+	assert.Nil(t, err)
+	select {
+	case <-time.After(time.Second):
+		t.Error("Timeout Error: invalid decision not reported")
+	case err := <-l.Errors:
+		assert.True(t, errors.Is(err, ErrInvalidFlagCombination))
+	}
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	// the file descriptors and pidfds of the events are closed
+	assert.Equal(t, fds, openFds(t))
+}
+
+func TestAllowlist(t *testing.T) {
+	testFile := fmt.Sprintf("%s/test.sh", t.TempDir())
+	content := []byte("#!/bin/sh\necho test\n")
+	assert.Nil(t, os.WriteFile(testFile, content, 0755))
+	digest := sha256.Sum256(content)
+
+	a, err := LoadAllowlist(strings.NewReader(fmt.Sprintf("# executables\n\n%x  %s\n", digest, testFile)))
+	assert.Nil(t, err)
+	assert.Equal(t, 1, a.Len())
+	for _, allowlist := range []string{"abcd  /bin/sh\n", "/bin/sh\n"} {
+		_, err := LoadAllowlist(strings.NewReader(allowlist))
+		assert.True(t, errors.Is(err, ErrInvalidAllowlist), allowlist)
+	}
+
+	fd, err := unix.Open(testFile, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	assert.Nil(t, err)
+	defer unix.Close(fd)
+	e := Event{Fd: fd, Path: testFile, EventTypes: FileOpenToExecutePermission}
+	allowed, err := a.Allowed(e)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	allowed, err = a.Allowed(e)
+	assert.Nil(t, err)
+	assert.True(t, allowed)
+	assert.Equal(t, 1, len(a.cache))
+
+	// the cached digest is not used once the file changes
+	assert.Nil(t, os.WriteFile(testFile, []byte("#!/bin/sh\necho modified\n"), 0755))
+	allowed, err = a.Allowed(e)
+	assert.Nil(t, err)
+	assert.False(t, allowed)
+	assert.Equal(t, 2, len(a.cache))
+}
+
+func TestWithCapSysAdmEnforceAllowlist(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithReportPidfd())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	allowedScript := fmt.Sprintf("%s/allowed.sh", watchDir)
+	deniedScript := fmt.Sprintf("%s/denied.sh", watchDir)
+	content := []byte("#!/bin/sh\nexit 0\n")
+	assert.Nil(t, os.WriteFile(allowedScript, content, 0755))
+	assert.Nil(t, os.WriteFile(deniedScript, []byte("#!/bin/sh\nexit 1\n"), 0755))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenToExecutePermission))
+	a, err := NewAllowlist(fmt.Sprintf("%x", sha256.Sum256(content)))
+	assert.Nil(t, err)
+	go l.Start()
+	fds := openFds(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.EnforceAllowlist(ctx, a)
+	}()
+
+	// the scripts are executed by a child shell as the listener must not execute
+	// the files it checks itself
+	_, err = runAsCmd("sh", "-c", allowedScript)
+	assert.Nil(t, err)
+	_, err = runAsCmd("sh", "-c", allowedScript)
+	assert.Nil(t, err)
+	_, err = runAsCmd("sh", "-c", deniedScript)
+	assert.NotNil(t, err)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, fds, openFds(t))
+	assert.Equal(t, 2, len(a.cache))
+}
+
+func TestPatternScanner(t *testing.T) {
+	s, err := NewPatternScanner(
+		Signature{Name: "marker", Hex: "4d 41 ?? 4b"},
+		Signature{Name: "elf", Hex: "7f454c46"},
+	)
+	assert.Nil(t, err)
+	dir := t.TempDir()
+	scan := func(content []byte) ScanResult {
+		name := fmt.Sprintf("%s/scanned", dir)
+		assert.Nil(t, os.WriteFile(name, content, 0666))
+		f, err := os.Open(name)
+		assert.Nil(t, err)
+		defer f.Close()
+		result, err := s.Scan(context.Background(), f)
+		assert.Nil(t, err)
+		return result
+	}
+	assert.Equal(t, ScanResult{}, scan([]byte("clean content")))
+	assert.Equal(t, ScanResult{Infected: true, Signature: "marker"}, scan([]byte("a MARK b")))
+	assert.Equal(t, ScanResult{Infected: true, Signature: "marker"}, scan([]byte("a MA_K b")))
+	assert.Equal(t, ScanResult{}, scan([]byte("MAR")))
+	// the pattern crosses the boundary of the chunks read
+	content := append(bytes.Repeat([]byte{0}, scanChunkSize-2), 0x7f, 'E', 'L', 'F')
+	assert.Equal(t, ScanResult{Infected: true, Signature: "elf"}, scan(content))
+
+	for _, sig := range []Signature{
+		{Hex: "4d5a"},
+		{Name: "odd", Hex: "4d5"},
+		{Name: "digits", Hex: "4g"},
+		{Name: "any", Hex: "?? ??"},
+	} {
+		_, err := NewPatternScanner(sig)
+		assert.True(t, errors.Is(err, ErrInvalidSignature), sig.Name)
+	}
+}
+
+func TestSocketScanner(t *testing.T) {
+	socket := fmt.Sprintf("%s/scanner.sock", t.TempDir())
+	ln, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	assert.Nil(t, err)
+	defer ln.Close()
+	// the daemon reports the files containing "infected"
+	go func() {
+		for {
+			conn, err := ln.AcceptUnix()
+			if err != nil {
+				return
+			}
+			buf := make([]byte, 64)
+			oob := make([]byte, unix.CmsgSpace(4))
+			n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+			if err != nil || string(buf[:n]) != "nFILDES\n" {
+				fmt.Fprintf(conn, "%s ERROR\n", buf[:n])
+				conn.Close()
+				continue
+			}
+			msgs, _ := unix.ParseSocketControlMessage(oob[:oobn])
+			fds, _ := unix.ParseUnixRights(&msgs[0])
+			f := os.NewFile(uintptr(fds[0]), "")
+			content, _ := io.ReadAll(f)
+			f.Close()
+			if bytes.Contains(content, []byte("infected")) {
+				fmt.Fprintf(conn, "fd[%d]: Test.Infected FOUND\n", fds[0])
+			} else {
+				fmt.Fprintf(conn, "fd[%d]: OK\n", fds[0])
+			}
+			conn.Close()
+		}
+	}()
+
+	s := &SocketScanner{Path: socket, Timeout: time.Second}
+	dir := t.TempDir()
+	for content, expected := range map[string]ScanResult{
+		"clean":    {},
+		"infected": {Infected: true, Signature: "Test.Infected"},
+	} {
+		name := fmt.Sprintf("%s/%s", dir, content)
+		assert.Nil(t, os.WriteFile(name, []byte(content), 0666))
+		f, err := os.Open(name)
+		assert.Nil(t, err)
+		result, err := s.Scan(context.Background(), f)
+		f.Close()
+		assert.Nil(t, err)
+		assert.Equal(t, expected, result)
+	}
+
+	_, err = parseScanReply("fd[3]: lstat() failed ERROR\n")
+	assert.True(t, errors.Is(err, ErrScanFailed))
+	_, err = parseScanReply("garbage\n")
+	assert.True(t, errors.Is(err, ErrScanFailed))
+}
+
+func TestWithCapSysAdmEnforceScanner(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithReportPidfd())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	cleanFile := fmt.Sprintf("%s/clean.txt", watchDir)
+	infectedFile := fmt.Sprintf("%s/infected.txt", watchDir)
+	assert.Nil(t, os.WriteFile(cleanFile, []byte("clean"), 0666))
+	assert.Nil(t, os.WriteFile(infectedFile, []byte("MARK"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission|FileClosedAfterWrite))
+	s, err := NewPatternScanner(Signature{Name: "marker", Hex: "4d 41 52 4b"})
+	assert.Nil(t, err)
+	go l.Start()
+	fds := openFds(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.EnforceScanner(ctx, s)
+	}()
+
+	_, err = runAsCmd("cat", cleanFile)
+	assert.Nil(t, err)
+	_, err = runAsCmd("cat", infectedFile)
+	assert.NotNil(t, err)
+	select {
+	case err := <-l.Errors:
+		assert.True(t, errors.Is(err, ErrInfected))
+	case <-time.After(time.Second):
+		t.Error("infected file not reported on the Errors channel")
+	}
+	// the cached verdict is discarded once the file is written
+	assert.Nil(t, os.WriteFile(cleanFile, []byte("MARK"), 0666))
+	_, err = runAsCmd("cat", cleanFile)
+	assert.NotNil(t, err)
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, fds, openFds(t))
+}
+
+func TestWithCapSysAdmHandlePermissions(t *testing.T) {
+	decisions := make(chan PermissionDecision, 16)
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithDecisionReporter(func(d PermissionDecision) {
+		decisions <- d
+	}))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	slowFile := fmt.Sprintf("%s/slow.txt", watchDir)
+	fastFile := fmt.Sprintf("%s/fast.txt", watchDir)
+	deniedFile := fmt.Sprintf("%s/denied.txt", watchDir)
+	for _, name := range []string{slowFile, fastFile, deniedFile} {
+		assert.Nil(t, os.WriteFile(name, []byte("test"), 0666))
+	}
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	assert.Equal(t, os.ErrInvalid, l.HandlePermissions(0, func(Event) Decision { return Allow }))
+	go l.Start()
+
+	deciding := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- l.HandlePermissions(2, func(e Event) Decision {
+			switch eventPath(e) {
+			case slowFile:
+				close(deciding)
+				<-release
+			case deniedFile:
+				return Deny
+			}
+			return Allow
+		})
+	}()
+
+	slow := make(chan error, 1)
+	go func() {
+		_, err := runAsCmd("cat", slowFile)
+		slow <- err
+	}()
+	select {
+	case <-deciding:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: FileOpenPermission event not received")
+	}
+	// the other events are decided while the slow decision is pending
+	_, err = runAsCmd("cat", fastFile)
+	assert.Nil(t, err)
+	_, err = runAsCmd("cat", deniedFile)
+	assert.NotNil(t, err)
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.Nil(t, <-slow)
+
+	reported := make(map[string]PermissionDecision)
+	for i := 0; i < 3; i++ {
+		select {
+		case d := <-decisions:
+			reported[eventPath(d.Event)] = d
+		case <-time.After(time.Second):
+			t.Fatal("Timeout Error: decision not reported")
+		}
+	}
+	assert.Equal(t, Allow, reported[fastFile].Decision)
+	assert.Equal(t, Deny, reported[deniedFile].Decision)
+	assert.Equal(t, Allow, reported[slowFile].Decision)
+	assert.True(t, reported[slowFile].Latency >= 10*time.Millisecond)
+	l.Stop()
+	assert.Nil(t, <-done)
+}
+
+func TestWithCapSysAdmAllowCache(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithAllowCache())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission))
+	go l.Start()
+	decided := make(chan string, 16)
+	go l.HandlePermissions(1, func(e Event) Decision {
+		decided <- eventPath(e)
+		return Allow
+	})
+	decisions := func() int {
+		n := 0
+		for {
+			select {
+			case <-decided:
+				n++
+			case <-time.After(100 * time.Millisecond):
+				return n
+			}
+		}
+	}
+
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, decisions())
+	// the modification clears the cached decision
+	f, err := os.OpenFile(testFile, os.O_WRONLY|os.O_APPEND, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, decisions())
+	_, err = f.WriteString("modified")
+	assert.Nil(t, err)
+	f.Close()
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, decisions())
+	assert.Nil(t, l.FlushAllowCache())
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, decisions())
+	// the handles are opened through the root of the mount, not the allowed file
+	l.mu.Lock()
+	assert.Equal(t, 1, len(l.allowCache.mounts))
+	for _, fd := range l.allowCache.mounts {
+		var stat unix.Stat_t
+		assert.Nil(t, unix.Fstat(fd, &stat))
+		assert.Equal(t, uint32(unix.S_IFDIR), stat.Mode&unix.S_IFMT)
+	}
+	l.mu.Unlock()
+}
+
+func TestWithCapSysAdmAllowCacheDirectory(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PostContent), WithAllowCache())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	assert.Nil(t, l.AddWatch(watchDir, FileOpenPermission|unix.FAN_ONDIR))
+	go l.Start()
+	decided := make(chan string, 16)
+	go l.HandlePermissions(1, func(e Event) Decision {
+		decided <- eventPath(e)
+		return Allow
+	})
+	received := func(path string) bool {
+		for {
+			select {
+			case p := <-decided:
+				if p == path {
+					return true
+				}
+			case <-time.After(100 * time.Millisecond):
+				return false
+			}
+		}
+	}
+
+	_, err = runAsCmd("ls", watchDir)
+	assert.Nil(t, err)
+	assert.True(t, received(watchDir))
+	// allowing the directory does not ignore the events of its children
+	_, err = runAsCmd("cat", testFile)
+	assert.Nil(t, err)
+	assert.True(t, received(testFile))
+	l.mu.Lock()
+	assert.Equal(t, 1, len(l.allowCache.files))
+	l.mu.Unlock()
+}
+
+func TestUnescapeMountPath(t *testing.T) {
+	assert.Equal(t, "/", unescapeMountPath("/"))
+	assert.Equal(t, "/mnt/a b\\c", unescapeMountPath("/mnt/a\\040b\\134c"))
+	assert.Equal(t, "/mnt/a\\", unescapeMountPath("/mnt/a\\"))
+}
+
+func TestWithCapSysAdmPreAccess(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithPermissionType(PreContent), WithReadWrite())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	if !l.features.HasEvents(FilePreAccess) {
+		t.Skip("pre-access events require Linux kernel 6.14 or later")
+	}
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	content := []byte("lazily populated content")
+	// the file has its final size but no content until it is accessed
+	assert.Nil(t, os.WriteFile(testFile, nil, 0666))
+	assert.Nil(t, os.Truncate(testFile, int64(len(content))))
+	err = l.AddWatch(watchDir, FilePreAccess)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		t.Skip("the filesystem does not support pre-content events")
+	}
+	assert.Nil(t, err)
+	go l.Start()
+	ranges := make(chan *FileRange, 16)
+	go l.HandlePermissions(1, func(e Event) Decision {
+		ranges <- e.Range
+		if err := l.WriteContent(e, content, 0); err != nil {
+			t.Error(err)
+			return Deny
+		}
+		return Allow
+	})
+
+	output, err := exec.Command("cat", testFile).Output()
+	assert.Nil(t, err)
+	assert.Equal(t, content, output)
+	select {
+	case r := <-ranges:
+		assert.NotNil(t, r)
+	case <-time.After(time.Second):
+		t.Error("Timeout Error: FilePreAccess event not received")
+	}
+
+	notifications, err := NewListener("/", false, PostContent)
+	assert.Nil(t, err)
+	defer notifications.Stop()
+	assert.NotNil(t, notifications.AddWatch(watchDir, FilePreAccess))
+	assert.True(t, errors.Is(notifications.WriteContent(Event{Fd: 0}, content, 0), ErrInvalidFlagCombination))
+}
+
+func TestWithCapSysAdmEventFile(t *testing.T) {
+	// without file identifiers the file descriptors refer to the files themselves
+	l, err := NewListenerWithOptions("/", WithReportFlags(0))
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, l.AddWatch(watchDir, FileClosedAfterWrite))
+	go l.Start()
+	next := func() Event {
+		select {
+		case e := <-l.Events:
+			return e
+		case <-time.After(time.Second):
+			t.Fatal("Timeout Error: FileClosedAfterWrite event not received")
+		}
+		return Event{}
+	}
+
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	e := next()
+	f := e.File()
+	assert.NotNil(t, f)
+	assert.Equal(t, f, e.File())
+	content := make([]byte, 4)
+	_, err = f.ReadAt(content, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("test"), content)
+	// closing any copy of the event closes the file once
+	copied := e
+	assert.Nil(t, copied.Close())
+	assert.Nil(t, e.Close())
+	assert.Nil(t, e.File())
+	_, err = f.ReadAt(content, 0)
+	assert.NotNil(t, err)
+
+	// closing an event closed with unix.Close does not close the file that reused
+	// its number
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	e = next()
+	unix.Close(e.Fd)
+	other, err := unix.Open(watchDir, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, e.Fd, other)
+	assert.Nil(t, e.Close())
+	_, err = unix.FcntlInt(uintptr(other), unix.F_GETFD, 0)
+	assert.Nil(t, err)
+	unix.Close(other)
+
+	// an event closed with unix.Close and one left open are dropped; only the
+	// latter is counted as leaked
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	e = next()
+	unix.Close(e.Fd)
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	e = next()
+	leaked := e.Fd
+	e = Event{}
+	for i := 0; i < 100 && l.LeakedFds() == 0; i++ {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(1), l.LeakedFds())
+	unix.Close(leaked)
+}
+
+func TestWithCapSysAdmAutoClose(t *testing.T) {
+	l, err := NewListenerWithOptions("/", WithAutoClose())
+	assert.Nil(t, err)
+	assert.NotNil(t, l)
+	defer l.Stop()
+	watchDir := t.TempDir()
+	testFile := fmt.Sprintf("%s/test.txt", watchDir)
+	assert.Nil(t, l.AddWatch(watchDir, FileClosedAfterWrite))
+	assert.Equal(t, os.ErrInvalid, l.HandleEvents(nil))
+	go l.Start()
+	handled := make(chan Event, 1)
+	go l.HandleEvents(func(e Event) {
+		assert.NotNil(t, e.File())
+		handled <- e
+	})
+
+	assert.Nil(t, os.WriteFile(testFile, []byte("test"), 0666))
+	var e Event
+	select {
+	case e = <-handled:
+	case <-time.After(time.Second):
+		t.Fatal("Timeout Error: FileClosedAfterWrite event not received")
+	}
+	// the file descriptor is closed once the handler returns
+	for i := 0; i < 100 && e.File() != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Nil(t, e.File())
+	assert.Nil(t, e.Close())
+}